@@ -6,7 +6,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
+	"runtime"
 	"strings"
 
 	"golang.org/x/tools/go/buildutil"
@@ -14,11 +14,11 @@ import (
 
 // Recursively :
 func Recursively() *Context {
-	var c *Context
-	c = &Context{
+	return &Context{
 		Ctxt: &build.Default,
 		MatchPkg: func(this, other string) bool {
-			return strings.HasPrefix(other, this)
+			// on path-segment boundaries ("foo/bar" is not matched with "foo/barbaz")
+			return this == other || strings.HasPrefix(other, this+"/")
 		},
 		WriteFile: func(path string, b []byte) error {
 			return ioutil.WriteFile(path, b, 0744)
@@ -26,50 +26,19 @@ func Recursively() *Context {
 		MkdirAll: func(path string) error {
 			return os.MkdirAll(path, 0744)
 		},
-		MoveFile: func(src, dst string) error {
-			if err := os.Chdir(src); err != nil {
-				return err
-			}
-			return exec.Command("git", "mv", src, dst).Run()
-		},
+		RemoveAll: os.RemoveAll,
+		VCS:       Auto,
+		Jobs:      runtime.NumCPU(),
 	}
-	return c
 }
 
 // OnePackageOnly :
 func OnePackageOnly() *Context {
-	var c *Context
-	c = &Context{
-		Ctxt: &build.Default,
-		MatchPkg: func(this, other string) bool {
-			return this == other
-		},
-		WriteFile: func(path string, b []byte) error {
-			return ioutil.WriteFile(path, b, 0744)
-		},
-		MkdirAll: func(path string) error {
-			return os.MkdirAll(path, 0744)
-		},
-		MoveFile: func(src, dst string) error {
-			if err := os.Chdir(src); err != nil {
-				return err
-			}
-			fs, err := c.ReadDir(src)
-			if err != nil {
-				return err
-			}
-			c.MkdirAll(dst)
-			for _, f := range fs {
-				if strings.HasSuffix(f.Name(), ".go") {
-					log.Println("git", "mv", c.JoinPath(src, f.Name()), c.JoinPath(dst, f.Name()))
-					if err := exec.Command("git", "mv", c.JoinPath(src, f.Name()), c.JoinPath(dst, f.Name())).Run(); err != nil {
-						return err
-					}
-				}
-			}
-			return nil
-		},
+	c := Recursively()
+	c.MatchPkg = func(this, other string) bool {
+		return this == other
 	}
+	c.OnePackage = true
 	return c
 }
 
@@ -82,7 +51,54 @@ type Context struct {
 	MatchPkg  func(this, other string) bool
 	WriteFile func(path string, b []byte) error
 	MkdirAll  func(path string) error
-	MoveFile  func(src, dst string) error
+	RemoveAll func(path string) error
+	MoveFile  func(src, dst string) error // if nil, moved by VCS (see Move)
+	VCS       VCS
+	Jobs      int // the number of concurrent workers (for scanning)
+
+	OnePackage bool // only the go files of the package are moved (sub packages are not moved)
+}
+
+// Move moves the file (or the directory) by MoveFile. if MoveFile is nil, by the VCS of ctxt
+// (resolved at call time, so the VCS of the copied context is used)
+func (ctxt *Context) Move(src, dst string) error {
+	if ctxt.MoveFile != nil {
+		return ctxt.MoveFile(src, dst)
+	}
+	return ctxt.VCS.Move(src, dst)
+}
+
+// MovePackage moves the package directory (if OnePackage, only the go files are moved, one by one).
+// each change is made via the fields of ctxt, so they are recorded by the wrapped context (e.g. journal)
+func (ctxt *Context) MovePackage(src, dst string) error {
+	if !ctxt.OnePackage {
+		return ctxt.Move(src, dst)
+	}
+
+	fs, err := ctxt.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	if err := ctxt.MkdirAll(dst); err != nil {
+		return err
+	}
+	for _, f := range fs {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".go") {
+			log.Println(ctxt.VCS.Name(), "mv", ctxt.JoinPath(src, f.Name()), ctxt.JoinPath(dst, f.Name()))
+			if err := ctxt.Move(ctxt.JoinPath(src, f.Name()), ctxt.JoinPath(dst, f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RenamePkg returns the import path after moving (if not matched, returns path as is)
+func (ctxt *Context) RenamePkg(from, to, path string) string {
+	if !ctxt.MatchPkg(from, path) {
+		return path
+	}
+	return to + path[len(from):]
 }
 
 // JoinPath :
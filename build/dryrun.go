@@ -0,0 +1,37 @@
+package build
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/podhmo/gomvpkg-light/diff"
+)
+
+// DryRun : nothing is written, the changes are printed as unified diff, instead
+func DryRun(ctxt *Context, w io.Writer) *Context {
+	c := *ctxt
+	c.WriteFile = func(path string, b []byte) error {
+		var original []byte
+		if r, err := ctxt.OpenFile(path); err == nil {
+			original, err = ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				return err
+			}
+		}
+		_, err := w.Write(diff.Unified(path, path, original, b))
+		return err
+	}
+	c.MkdirAll = func(path string) error {
+		return nil
+	}
+	c.RemoveAll = func(path string) error {
+		return nil
+	}
+	c.MoveFile = func(src, dst string) error {
+		_, err := fmt.Fprintf(w, "rename from %s\nrename to %s\n", src, dst)
+		return err
+	}
+	return &c
+}
@@ -0,0 +1,108 @@
+package build
+
+import (
+	"io/ioutil"
+	"log"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Journal : records the changes, for rollback
+type Journal struct {
+	ctxt    *Context
+	backups []backup
+	dirs    []string
+	moves   [][2]string
+}
+
+type backup struct {
+	path    string
+	content []byte
+	existed bool
+}
+
+// Transactional : returns context recording each change into journal
+func Transactional(ctxt *Context) (*Context, *Journal) {
+	j := &Journal{ctxt: ctxt}
+	c := *ctxt
+	c.WriteFile = func(path string, b []byte) error {
+		bk := backup{path: path}
+		if r, err := ctxt.OpenFile(path); err == nil {
+			bk.content, err = ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				return errors.Wrapf(err, "backup %s", path)
+			}
+			bk.existed = true
+		}
+		j.backups = append(j.backups, bk)
+		return ctxt.WriteFile(path, b)
+	}
+	c.MkdirAll = func(path string) error {
+		// only the top of newly created directories is recorded
+		top := ""
+		for p := path; !ctxt.IsDir(p); {
+			top = p
+			parent := filepath.Dir(p)
+			if parent == p {
+				break
+			}
+			p = parent
+		}
+		if err := ctxt.MkdirAll(path); err != nil {
+			return err
+		}
+		if top != "" {
+			j.dirs = append(j.dirs, top)
+		}
+		return nil
+	}
+	c.MoveFile = func(src, dst string) error {
+		if err := ctxt.Move(src, dst); err != nil {
+			return err
+		}
+		j.moves = append(j.moves, [2]string{src, dst})
+		return nil
+	}
+	return &c, j
+}
+
+// Rollback : restores all recorded changes, in reverse order
+func (j *Journal) Rollback() error {
+	var errs []error
+	for i := len(j.moves) - 1; i >= 0; i-- {
+		src, dst := j.moves[i][0], j.moves[i][1]
+		log.Printf("rollback, move %s -> %s", dst, src)
+		if err := j.ctxt.MkdirAll(filepath.Dir(src)); err != nil { // removed after merging
+			errs = append(errs, errors.Wrapf(err, "mkdir %s", filepath.Dir(src)))
+			continue
+		}
+		if err := j.ctxt.Move(dst, src); err != nil {
+			errs = append(errs, errors.Wrapf(err, "move %s -> %s", dst, src))
+		}
+	}
+	for i := len(j.backups) - 1; i >= 0; i-- {
+		bk := j.backups[i]
+		if !bk.existed {
+			if err := j.ctxt.RemoveAll(bk.path); err != nil {
+				errs = append(errs, errors.Wrapf(err, "remove %s", bk.path))
+			}
+			continue
+		}
+		if err := j.ctxt.WriteFile(bk.path, bk.content); err != nil {
+			errs = append(errs, errors.Wrapf(err, "restore %s", bk.path))
+		}
+	}
+	for i := len(j.dirs) - 1; i >= 0; i-- {
+		if err := j.ctxt.RemoveAll(j.dirs[i]); err != nil {
+			errs = append(errs, errors.Wrapf(err, "remove %s", j.dirs[i]))
+		}
+	}
+	j.moves, j.backups, j.dirs = nil, nil, nil
+
+	if len(errs) > 0 {
+		return errors.Errorf("rollback is failed, %v", errs)
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package build
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// VCS : version control system, moving files (src and dst are absolute paths)
+type VCS interface {
+	Name() string
+	Move(src, dst string) error
+	Status(paths ...string) ([]string, error) // returns uncommitted changes (including untracked files)
+	Commit(message string, paths ...string) error
+}
+
+var (
+	// Git :
+	Git VCS = &command{name: "git"}
+	// Mercurial :
+	Mercurial VCS = &command{name: "hg"}
+	// FileSystem : plain filesystem (without vcs)
+	FileSystem VCS = &filesystem{}
+	// Auto : detected by the directory of the source
+	Auto VCS = &auto{}
+)
+
+// LookupVCS :
+func LookupVCS(name string) (VCS, error) {
+	for _, vcs := range []VCS{Auto, Git, Mercurial, FileSystem} {
+		if vcs.Name() == name {
+			return vcs, nil
+		}
+	}
+	return nil, errors.Errorf("unsupported vcs %q", name)
+}
+
+// DetectVCS detects vcs, walking up from the path (if not found, FileSystem is used)
+func DetectVCS(path string) VCS {
+	dir := filepath.Clean(path)
+	for {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return Git
+		}
+		if _, err := os.Stat(filepath.Join(dir, ".hg")); err == nil {
+			return Mercurial
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return FileSystem
+		}
+		dir = parent
+	}
+}
+
+type command struct {
+	name string
+}
+
+func (c *command) Name() string {
+	return c.name
+}
+
+func (c *command) Move(src, dst string) error {
+	return c.run(filepath.Dir(src), "mv", src, dst)
+}
+
+func (c *command) Status(paths ...string) ([]string, error) {
+	paths = existed(paths)
+	if len(paths) == 0 {
+		return nil, nil
+	}
+
+	args := []string{"status"}
+	switch c.name {
+	case "git":
+		args = append(args, "--porcelain", "--")
+	case "hg":
+		args = append(args, "--modified", "--added", "--removed", "--deleted", "--unknown")
+	}
+	b, err := c.output(dirOf(paths[0]), append(args, paths...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.TrimSpace(line) != "" {
+			changes = append(changes, line)
+		}
+	}
+	return changes, nil
+}
+
+func (c *command) Commit(message string, paths ...string) error {
+	existed := existed(paths)
+	if len(existed) == 0 {
+		return errors.New("nothing to commit")
+	}
+	dir := dirOf(existed[0])
+
+	switch c.name {
+	case "git":
+		if err := c.run(dir, append([]string{"add", "-A", "--"}, existed...)...); err != nil {
+			return err
+		}
+		return c.run(dir, append([]string{"commit", "-q", "-m", message, "--"}, paths...)...)
+	case "hg":
+		if err := c.run(dir, append([]string{"addremove"}, existed...)...); err != nil {
+			return err
+		}
+		return c.run(dir, append([]string{"commit", "-m", message}, paths...)...)
+	}
+	return errors.Errorf("commit is not supported (%s)", c.name)
+}
+
+// run runs the command in dir (the working directory of the process is not changed)
+func (c *command) run(dir string, args ...string) error {
+	cmd := exec.Command(c.name, args...)
+	cmd.Dir = dir
+	if b, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "%s %s, %s", c.name, strings.Join(args, " "), b)
+	}
+	return nil
+}
+
+func (c *command) output(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command(c.name, args...)
+	cmd.Dir = dir
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	b, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s %s, %s", c.name, strings.Join(args, " "), stderr.String())
+	}
+	return b, nil
+}
+
+type auto struct{}
+
+func (a *auto) Name() string {
+	return "auto"
+}
+
+func (a *auto) Move(src, dst string) error {
+	return DetectVCS(src).Move(src, dst)
+}
+
+func (a *auto) Commit(message string, paths ...string) error {
+	existed := existed(paths)
+	if len(existed) == 0 {
+		return errors.New("nothing to commit")
+	}
+	return DetectVCS(existed[0]).Commit(message, paths...)
+}
+
+func (a *auto) Status(paths ...string) ([]string, error) {
+	paths = existed(paths)
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	return DetectVCS(paths[0]).Status(paths...)
+}
+
+type filesystem struct{}
+
+func (fs *filesystem) Name() string {
+	return "none"
+}
+
+func (fs *filesystem) Move(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+	if lerr, ok := err.(*os.LinkError); !ok || lerr.Err != syscall.EXDEV {
+		return err
+	}
+
+	// cross-device, copy and remove
+	if err := copyAll(src, dst); err != nil {
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+func (fs *filesystem) Status(paths ...string) ([]string, error) {
+	return nil, nil // always clean
+}
+
+func (fs *filesystem) Commit(message string, paths ...string) error {
+	return errors.New("commit is not supported (without vcs)")
+}
+
+func existed(paths []string) []string {
+	var r []string
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			r = append(r, path)
+		}
+	}
+	return r
+}
+
+func dirOf(path string) string {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return path
+	}
+	return filepath.Dir(path)
+}
+
+func copyAll(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode())
+		}
+
+		r, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		w, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			w.Close()
+			return err
+		}
+		return w.Close()
+	})
+}
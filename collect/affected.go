@@ -4,8 +4,10 @@ import (
 	"go/parser"
 	"go/token"
 	"log"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/podhmo/gomvpkg-light/build"
 )
@@ -21,69 +23,130 @@ type Affected struct {
 }
 
 // AffectedPackages :
-func AffectedPackages(ctxt *build.Context, srcpkg string, root *Target, pkgdirs []string) ([]Affected, error) {
-	var affected []Affected
-
+// (if idx is not nil, the imports of unchanged files are read from idx)
+func AffectedPackages(ctxt *build.Context, srcpkg string, root *Target, pkgdirs []string, idx *Index) ([]Affected, error) {
 	fset := token.NewFileSet()
-	for _, dir := range pkgdirs {
-		fs, err := ctxt.ReadDir(dir)
-		if err != nil {
-			return nil, err
-		}
 
-		item := Affected{
-			Dir:            dir,
-			Pkg:            dir[len(root.Dir)+1:],
-			ShallowImports: map[string]bool{},
+	// scanning with bounded workers, the order of results is same as pkgdirs
+	results := make([][]Affected, len(pkgdirs))
+	errs := make([]error, len(pkgdirs))
+
+	jobs := ctxt.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	q := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range q {
+				results[i], errs[i] = affectedPackagesInDir(ctxt, fset, idx, srcpkg, root, pkgdirs[i])
+			}
+		}()
+	}
+	for i := range pkgdirs {
+		q <- i
+	}
+	close(q)
+	wg.Wait()
+
+	var affected []Affected
+	for i := range pkgdirs {
+		if errs[i] != nil {
+			return nil, errs[i]
 		}
+		affected = append(affected, results[i]...)
+	}
+	return affected, nil
+}
 
-		// xxx_test package
-		testitem := item
-		testitem.IsXTest = true
-		testitem.Pkg = item.Pkg + "_test"
+func affectedPackagesInDir(ctxt *build.Context, fset *token.FileSet, idx *Index, srcpkg string, root *Target, dir string) ([]Affected, error) {
+	var affected []Affected
+
+	fs, err := ctxt.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	item := Affected{
+		Dir:            dir,
+		Pkg:            root.ImportPath(dir),
+		ShallowImports: map[string]bool{},
+	}
 
-		for _, f := range fs {
-			if !strings.HasSuffix(f.Name(), ".go") {
+	// xxx_test package
+	testitem := item
+	testitem.IsXTest = true
+	testitem.Pkg = item.Pkg + "_test"
+
+	files := map[string]FileEntry{}
+	changed := false
+	for _, f := range fs {
+		if !strings.HasSuffix(f.Name(), ".go") {
+			continue
+		}
+
+		e, ok := idx.lookup(dir, f)
+		if !ok {
+			e, err = scanFile(ctxt, fset, dir, f)
+			if err != nil {
+				log.Println(f.Name(), err)
 				continue
 			}
-			func() {
-				r, err := ctxt.OpenFile(ctxt.JoinPath(dir, f.Name()))
-				if err != nil {
-					log.Println(f.Name(), err)
-					return
-				}
-				defer r.Close()
-				astf, err := parser.ParseFile(fset, f.Name(), r, parser.ImportsOnly)
-				if err != nil {
-					log.Println(f.Name(), err)
-					return
-				}
-
-				target := &item
-				if strings.HasSuffix(astf.Name.Name, "_test") {
-					target = &testitem
-				}
-				target.Name = astf.Name.Name
-
-				for _, is := range astf.Imports {
-					path, err := strconv.Unquote(is.Path.Value)
-					if err != nil {
-						log.Println(f.Name(), err)
-					}
-					if ctxt.MatchPkg(srcpkg, path) {
-						target.Files = append(target.Files, f.Name())
-						break
-					}
-					target.ShallowImports[path] = true
-				}
-			}()
+			changed = true
 		}
-		if len(item.Files) > 0 {
-			affected = append(affected, item)
+		files[f.Name()] = e
+
+		target := &item
+		if strings.HasSuffix(e.Package, "_test") {
+			target = &testitem
 		}
-		if len(testitem.Files) > 0 {
-			affected = append(affected, testitem)
+		target.Name = e.Package
+
+		for _, path := range e.Imports {
+			if ctxt.MatchPkg(srcpkg, path) {
+				target.Files = append(target.Files, f.Name())
+				break
+			}
+			target.ShallowImports[path] = true
 		}
 	}
+	idx.update(dir, files, changed)
+
+	if len(item.Files) > 0 {
+		affected = append(affected, item)
+	}
+	if len(testitem.Files) > 0 {
+		affected = append(affected, testitem)
+	}
 	return affected, nil
 }
+
+// scanFile parses the imports of the file
+func scanFile(ctxt *build.Context, fset *token.FileSet, dir string, info os.FileInfo) (FileEntry, error) {
+	r, err := ctxt.OpenFile(ctxt.JoinPath(dir, info.Name()))
+	if err != nil {
+		return FileEntry{}, err
+	}
+	defer r.Close()
+	astf, err := parser.ParseFile(fset, info.Name(), r, parser.ImportsOnly)
+	if err != nil {
+		return FileEntry{}, err
+	}
+
+	e := FileEntry{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Package: astf.Name.Name,
+	}
+	for _, is := range astf.Imports {
+		path, err := strconv.Unquote(is.Path.Value)
+		if err != nil {
+			log.Println(info.Name(), err)
+		}
+		e.Imports = append(e.Imports, path)
+	}
+	return e, nil
+}
@@ -1,40 +1,101 @@
 package collect
 
 import (
+	"context"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
 	"github.com/podhmo/gomvpkg-light/build"
 )
 
-// GoFilesDirectories finds go package in inpkg
-func GoFilesDirectories(ctxt *build.Context, root *Target) ([]string, error) {
-	var pkgdirs []string
-	q := []string{root.Path}
+// GoFilesDirectories finds go package in inpkg (the result is sorted, the directories matched by Ignore and the nested modules are skipped)
+func GoFilesDirectories(ctx context.Context, ctxt *build.Context, root *Target) ([]string, error) {
+	ig, err := LoadIgnore(ctxt, root.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := ctxt.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	sem := make(chan struct{}, jobs) // bounding the number of concurrent ReadDir
 
-	for len(q) > 0 {
-		dir := q[0]
-		q = q[1:]
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		pkgdirs []string
+		rerr    error
+	)
 
+	var walk func(dir string)
+	walk = func(dir string) {
+		defer wg.Done()
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
 		fs, err := ctxt.ReadDir(dir)
+		<-sem
+
 		if err != nil {
-			return nil, errors.Wrap(err, "collect go files directories")
+			mu.Lock()
+			if rerr == nil {
+				rerr = errors.Wrap(err, "collect go files directories")
+			}
+			mu.Unlock()
+			cancel()
+			return
+		}
+
+		if dir != root.Path {
+			for _, f := range fs {
+				if f.Name() == "go.mod" && !f.IsDir() {
+					return // nested module, like the go tool
+				}
+			}
 		}
 
 		used := false
 		for _, f := range fs {
 			if f.IsDir() {
-				q = append(q, ctxt.JoinPath(dir, f.Name()))
+				subdir := ctxt.JoinPath(dir, f.Name())
+				if ig.Match(subdir) {
+					continue
+				}
+				wg.Add(1)
+				go walk(subdir)
 				continue
 			}
 			if used {
 				continue
 			}
 			if strings.HasSuffix(f.Name(), ".go") {
+				mu.Lock()
 				pkgdirs = append(pkgdirs, dir)
+				mu.Unlock()
 				used = true
 			}
 		}
 	}
+
+	wg.Add(1)
+	go walk(root.Path)
+	wg.Wait()
+
+	if rerr != nil {
+		return nil, rerr
+	}
+	if err := parent.Err(); err != nil {
+		return nil, err
+	}
+	sort.Strings(pkgdirs)
 	return pkgdirs, nil
 }
@@ -0,0 +1,75 @@
+package collect
+
+import (
+	"bufio"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/podhmo/gomvpkg-light/build"
+)
+
+// IgnoreFile : the file including glob patterns, placed at the root of the target area
+const IgnoreFile = ".gomvpkgignore"
+
+// Ignore : ignore rules for collecting candidate directories
+type Ignore struct {
+	Root     string
+	Patterns []string // glob patterns (matched with the slash separated path from root, or the base name)
+}
+
+// LoadIgnore loads the ignore rules of root (if IgnoreFile is not found, only the go tool's rules are used)
+func LoadIgnore(ctxt *build.Context, root string) (*Ignore, error) {
+	ig := &Ignore{Root: root}
+
+	r, err := ctxt.OpenFile(ctxt.JoinPath(root, IgnoreFile))
+	if err != nil {
+		return ig, nil // not found
+	}
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pattern := strings.Trim(line, "/")
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid pattern %q in %s", line, IgnoreFile)
+		}
+		ig.Patterns = append(ig.Patterns, pattern)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "read %s", IgnoreFile)
+	}
+	return ig, nil
+}
+
+// Match returns true if the directory should be ignored.
+// like the go tool, vendor, testdata, and the directories starting with "." or "_" are ignored
+func (ig *Ignore) Match(dir string) bool {
+	name := filepath.Base(dir)
+	if name == "vendor" || name == "testdata" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") {
+		return true
+	}
+	if len(ig.Patterns) == 0 {
+		return false
+	}
+
+	rel, err := filepath.Rel(ig.Root, dir)
+	if err != nil {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	for _, pattern := range ig.Patterns {
+		if ok, _ := path.Match(pattern, rel); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+package collect
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// indexVersion : if the format of the index is changed, this value is incremented (old index is discarded)
+const indexVersion = 1
+
+// Index : on-disk cache of the imports of each file (keyed by directory path, and file name, mtime and size)
+type Index struct {
+	Path string // the file storing the index
+
+	mu     sync.Mutex
+	dirs   map[string]map[string]FileEntry
+	dirty  bool
+	hits   int
+	misses int
+}
+
+// FileEntry : cached imports of a go file
+type FileEntry struct {
+	Size    int64    `json:"size"`
+	ModTime int64    `json:"mtime"` // unix nano
+	Package string   `json:"package"`
+	Imports []string `json:"imports"`
+}
+
+type indexFile struct {
+	Version int                             `json:"version"`
+	Dirs    map[string]map[string]FileEntry `json:"dirs"`
+}
+
+// IndexPath returns the path of the index for root, placed in cacheDir
+func IndexPath(cacheDir string, root *Target) string {
+	return filepath.Join(cacheDir, fmt.Sprintf("%x.json", sha1.Sum([]byte(root.Dir))))
+}
+
+// OpenIndex opens the index (if the file is not found or broken, empty index is returned)
+func OpenIndex(path string) (*Index, error) {
+	idx := &Index{Path: path, dirs: map[string]map[string]FileEntry{}}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return idx, nil
+		}
+		return nil, errors.Wrap(err, "open index")
+	}
+
+	var f indexFile
+	if err := json.Unmarshal(b, &f); err != nil || f.Version != indexVersion {
+		log.Printf("index %s is discarded (broken or old format)", path)
+		return idx, nil
+	}
+	if f.Dirs != nil {
+		idx.dirs = f.Dirs
+	}
+	return idx, nil
+}
+
+// lookup returns the cached entry, if the file is not changed (idx can be nil)
+func (idx *Index) lookup(dir string, info os.FileInfo) (FileEntry, bool) {
+	if idx == nil {
+		return FileEntry{}, false
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	e, ok := idx.dirs[dir][info.Name()]
+	if ok && e.Size == info.Size() && e.ModTime == info.ModTime().UnixNano() {
+		idx.hits++
+		return e, true
+	}
+	idx.misses++
+	return FileEntry{}, false
+}
+
+// update replaces the entries of dir (the removed files are also dropped)
+func (idx *Index) update(dir string, files map[string]FileEntry, changed bool) {
+	if idx == nil {
+		return
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if !changed && len(idx.dirs[dir]) == len(files) {
+		return
+	}
+	idx.dirs[dir] = files
+	idx.dirty = true
+}
+
+// Save writes the index, if changed
+func (idx *Index) Save() error {
+	if idx == nil {
+		return nil
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	log.Printf("index: %d files are reused, %d files are scanned", idx.hits, idx.misses)
+	if !idx.dirty {
+		return nil
+	}
+
+	b, err := json.Marshal(&indexFile{Version: indexVersion, Dirs: idx.dirs})
+	if err != nil {
+		return errors.Wrap(err, "save index")
+	}
+	if err := os.MkdirAll(filepath.Dir(idx.Path), 0755); err != nil {
+		return errors.Wrap(err, "save index")
+	}
+
+	// writing atomically (the index is shared by the concurrent invocations)
+	tmp, err := ioutil.TempFile(filepath.Dir(idx.Path), filepath.Base(idx.Path)+".*")
+	if err != nil {
+		return errors.Wrap(err, "save index")
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "save index")
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "save index")
+	}
+	if err := os.Rename(tmp.Name(), idx.Path); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "save index")
+	}
+	idx.dirty = false
+	return nil
+}
@@ -0,0 +1,91 @@
+package collect
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/podhmo/gomvpkg-light/build"
+	"golang.org/x/mod/modfile"
+)
+
+// Module :
+type Module struct {
+	Path string // module path (written in go.mod)
+	Dir  string // directory including go.mod
+}
+
+// FindModule finds the main module, walking up from the working directory.
+// if not found, returns nil (GOPATH mode)
+func FindModule(ctxt *build.Context) (*Module, error) {
+	if os.Getenv("GO111MODULE") == "off" {
+		return nil, nil
+	}
+
+	dir := ctxt.Ctxt.Dir
+	if dir == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return nil, errors.Wrap(err, "find module")
+		}
+		dir = cwd
+	}
+	dir = filepath.Clean(dir)
+
+	for {
+		if m, err := readModule(ctxt, dir); err != nil {
+			return nil, err
+		} else if m != nil {
+			return m, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil, nil
+		}
+		dir = parent
+	}
+}
+
+func readModule(ctxt *build.Context, dir string) (*Module, error) {
+	r, err := ctxt.OpenFile(ctxt.JoinPath(dir, "go.mod"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil // not found
+		}
+		return nil, errors.Wrapf(err, "open go.mod in %s", dir)
+	}
+	defer r.Close()
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read go.mod in %s", dir)
+	}
+	path := modfile.ModulePath(b)
+	if path == "" {
+		return nil, errors.Errorf("module path is not found in %s", ctxt.JoinPath(dir, "go.mod"))
+	}
+	return &Module{Path: path, Dir: dir}, nil
+}
+
+// Contains : pkg is a package of this module or not
+func (m *Module) Contains(pkg string) bool {
+	return pkg == m.Path || strings.HasPrefix(pkg, m.Path+"/")
+}
+
+// PathOf returns the directory of pkg
+func (m *Module) PathOf(ctxt *build.Context, pkg string) string {
+	if pkg == m.Path {
+		return m.Dir
+	}
+	return ctxt.JoinPath(m.Dir, filepath.FromSlash(strings.TrimPrefix(pkg, m.Path+"/")))
+}
+
+// ImportPath returns the import path of the package placed in dir
+func (m *Module) ImportPath(dir string) string {
+	if dir == m.Dir {
+		return m.Path
+	}
+	return m.Path + "/" + filepath.ToSlash(dir[len(m.Dir)+1:])
+}
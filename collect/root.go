@@ -9,13 +9,46 @@ import (
 type Target struct {
 	Dir        string
 	Pkg        string
-	Path       string // Dir + Pkg
+	Path       string // Dir + Pkg (or Module.Dir + relative path, in module mode)
 	NeedCreate bool
+	Module     *Module // not nil, if resolved via go.mod
+}
+
+// ImportPath returns the import path of the package placed in dir
+func (t *Target) ImportPath(dir string) string {
+	if t.Module != nil {
+		return t.Module.ImportPath(dir)
+	}
+	return dir[len(t.Dir)+1:]
 }
 
 // TargetRoot :
 func TargetRoot(ctxt *build.Context, inpkg string) (*Target, error) {
+	m, err := FindModule(ctxt)
+	if err != nil {
+		return nil, err
+	}
+	if m != nil && (inpkg == "" || m.Contains(inpkg)) {
+		if inpkg == "" {
+			inpkg = m.Path
+		}
+		path := m.PathOf(ctxt, inpkg)
+		if ctxt.IsDir(path) {
+			return &Target{
+				Dir:    m.Dir,
+				Path:   path,
+				Pkg:    inpkg,
+				Module: m,
+			}, nil
+		}
+		return nil, errors.Errorf("not found %s", inpkg)
+	}
+
+	goroot := ctxt.JoinPath(ctxt.Ctxt.GOROOT, "src")
 	for _, dir := range ctxt.SrcDirs() {
+		if dir == goroot {
+			continue // packages in GOROOT are not moved
+		}
 		path := ctxt.JoinPath(dir, inpkg)
 		if ctxt.IsDir(path) {
 			return &Target{
@@ -27,3 +60,26 @@ func TargetRoot(ctxt *build.Context, inpkg string) (*Target, error) {
 	}
 	return nil, errors.Errorf("not found %s", inpkg)
 }
+
+// NewTarget : target that is not existed yet (placed in same area of base).
+// in module mode, pkg must be in the module of base.
+func NewTarget(ctxt *build.Context, base *Target, pkg string) (*Target, error) {
+	if base.Module != nil {
+		if !base.Module.Contains(pkg) {
+			return nil, errors.Errorf("%s is not in the module %s", pkg, base.Module.Path)
+		}
+		return &Target{
+			Dir:        base.Module.Dir,
+			Pkg:        pkg,
+			Path:       base.Module.PathOf(ctxt, pkg),
+			NeedCreate: true,
+			Module:     base.Module,
+		}, nil
+	}
+	return &Target{
+		Dir:        base.Dir,
+		Pkg:        pkg,
+		Path:       ctxt.JoinPath(base.Dir, pkg),
+		NeedCreate: true,
+	}, nil
+}
@@ -0,0 +1,166 @@
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Context : the number of context lines in a hunk
+var Context = 3
+
+type edit struct {
+	kind byte // ' ', '-', '+'
+	line string
+}
+
+// Unified returns the diff text in unified format (if there is no difference, returns nil)
+func Unified(oldname, newname string, a, b []byte) []byte {
+	if bytes.Equal(a, b) {
+		return nil
+	}
+	edits := script(lines(a), lines(b))
+
+	var w bytes.Buffer
+	fmt.Fprintf(&w, "--- %s\n", oldname)
+	fmt.Fprintf(&w, "+++ %s\n", newname)
+
+	for i := 0; i < len(edits); {
+		if edits[i].kind == ' ' {
+			i++
+			continue
+		}
+
+		start := i - Context
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(edits); j++ {
+			if edits[j].kind != ' ' {
+				end = j + 1
+				continue
+			}
+			if j-end >= 2*Context {
+				break
+			}
+		}
+		end += Context
+		if end > len(edits) {
+			end = len(edits)
+		}
+
+		aline, bline := 1, 1
+		for _, e := range edits[:start] {
+			if e.kind != '+' {
+				aline++
+			}
+			if e.kind != '-' {
+				bline++
+			}
+		}
+		acount, bcount := 0, 0
+		for _, e := range edits[start:end] {
+			if e.kind != '+' {
+				acount++
+			}
+			if e.kind != '-' {
+				bcount++
+			}
+		}
+		if acount == 0 {
+			aline--
+		}
+		if bcount == 0 {
+			bline--
+		}
+
+		fmt.Fprintf(&w, "@@ -%d,%d +%d,%d @@\n", aline, acount, bline, bcount)
+		for _, e := range edits[start:end] {
+			w.WriteByte(e.kind)
+			w.WriteString(e.line)
+			if !strings.HasSuffix(e.line, "\n") {
+				w.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = end
+	}
+	return w.Bytes()
+}
+
+func lines(b []byte) []string {
+	if len(b) == 0 {
+		return nil
+	}
+	xs := strings.SplitAfter(string(b), "\n")
+	if xs[len(xs)-1] == "" {
+		xs = xs[:len(xs)-1]
+	}
+	return xs
+}
+
+// script computes the shortest edit script (myers's algorithm)
+func script(a, b []string) []edit {
+	n, m := len(a), len(b)
+	max := n + m
+	offset := max + 1
+	v := make([]int, 2*max+3)
+
+	var trace [][]int
+loop:
+	for d := 0; d <= max; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				break loop
+			}
+		}
+	}
+
+	// backtrack
+	var r []edit
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			r = append(r, edit{kind: ' ', line: a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				r = append(r, edit{kind: '+', line: b[y-1]})
+			} else {
+				r = append(r, edit{kind: '-', line: a[x-1]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+	return r
+}
@@ -0,0 +1,165 @@
+package diff
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// numbered returns the lines "1\n" ... "20\n" (replaced is used instead, for the given line numbers)
+func numbered(replaced map[int]string) string {
+	var b strings.Builder
+	for i := 1; i <= 20; i++ {
+		if s, ok := replaced[i]; ok {
+			b.WriteString(s + "\n")
+		} else {
+			fmt.Fprintf(&b, "%d\n", i)
+		}
+	}
+	return b.String()
+}
+
+func TestUnified(t *testing.T) {
+	tests := []struct {
+		msg  string
+		a, b string
+		want string
+	}{
+		{
+			msg:  "no difference",
+			a:    numbered(nil),
+			b:    numbered(nil),
+			want: "",
+		},
+		{
+			msg: "multiple hunks",
+			a:   numbered(nil),
+			b:   numbered(map[int]string{2: "two", 18: "eighteen"}),
+			want: `--- a
++++ b
+@@ -1,5 +1,5 @@
+ 1
+-2
++two
+ 3
+ 4
+ 5
+@@ -15,6 +15,6 @@
+ 15
+ 16
+ 17
+-18
++eighteen
+ 19
+ 20
+`,
+		},
+		{
+			msg: "hunks within 2*Context lines are merged",
+			a:   numbered(nil),
+			b:   numbered(map[int]string{5: "five", 12: "twelve"}),
+			want: `--- a
++++ b
+@@ -2,14 +2,14 @@
+ 2
+ 3
+ 4
+-5
++five
+ 6
+ 7
+ 8
+ 9
+ 10
+ 11
+-12
++twelve
+ 13
+ 14
+ 15
+`,
+		},
+		{
+			msg: "hunks over 2*Context lines are not merged",
+			a:   numbered(nil),
+			b:   numbered(map[int]string{5: "five", 13: "thirteen"}),
+			want: `--- a
++++ b
+@@ -2,7 +2,7 @@
+ 2
+ 3
+ 4
+-5
++five
+ 6
+ 7
+ 8
+@@ -10,7 +10,7 @@
+ 10
+ 11
+ 12
+-13
++thirteen
+ 14
+ 15
+ 16
+`,
+		},
+		{
+			msg: "new file",
+			a:   "",
+			b:   "a\nb\n",
+			want: `--- a
++++ b
+@@ -0,0 +1,2 @@
++a
++b
+`,
+		},
+		{
+			msg: "removed file",
+			a:   "a\nb\n",
+			b:   "",
+			want: `--- a
++++ b
+@@ -1,2 +0,0 @@
+-a
+-b
+`,
+		},
+		{
+			msg: "no newline at end of new file",
+			a:   "a\nb\n",
+			b:   "a\nb",
+			want: `--- a
++++ b
+@@ -1,2 +1,2 @@
+ a
+-b
++b
+\ No newline at end of file
+`,
+		},
+		{
+			msg: "no newline at end of old file",
+			a:   "a\nb",
+			b:   "a\nb\n",
+			want: `--- a
++++ b
+@@ -1,2 +1,2 @@
+ a
+-b
+\ No newline at end of file
++b
+`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.msg, func(t *testing.T) {
+			got := string(Unified("a", "b", []byte(test.a), []byte(test.b)))
+			if got != test.want {
+				t.Errorf("unified diff does not match expectation; got <<<%s>>>\nwant <<<%s>>>", got, test.want)
+			}
+		})
+	}
+}
@@ -1,32 +1,30 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"go/format"
+	"go/token"
+	"io"
 	"io/ioutil"
 	"os"
-	"path"
+	"os/exec"
 	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/podhmo/gomvpkg-light/build"
-	"golang.org/x/tools/go/buildutil"
+	"github.com/podhmo/gomvpkg-light/collect"
+	"github.com/podhmo/gomvpkg-light/load"
+	"github.com/podhmo/gomvpkg-light/move"
 )
 
-type fakeDirInfo string
-
-func (fd fakeDirInfo) Name() string    { return string(fd) }
-func (fakeDirInfo) Sys() interface{}   { return nil }
-func (fakeDirInfo) ModTime() time.Time { return time.Time{} }
-func (fakeDirInfo) IsDir() bool        { return true }
-func (fakeDirInfo) Size() int64        { return 0 }
-func (fakeDirInfo) Mode() os.FileMode  { return 0755 }
-
-// Simplifying wrapper around buildutil.FakeContext for packages whose
+// Simplifying wrapper around FakeContext for packages whose
 // filenames are sequentially numbered (%d.go).  pkgs maps a package
 // import path to its list of file contents.
-func fakeContext(pkgs map[string][]string) *build.OriginalContext {
+func fakeContext(pkgs map[string][]string) fakeGopath {
 	pkgs2 := make(map[string]map[string]string)
 	for path, files := range pkgs {
 		filemap := make(map[string]string)
@@ -38,49 +36,53 @@ func fakeContext(pkgs map[string][]string) *build.OriginalContext {
 	return FakeContext(pkgs2)
 }
 
-// FakeContext : replacement for buildutil.FakeContext
-func FakeContext(pkgs2 map[string]map[string]string) *build.OriginalContext {
-	ctxt := buildutil.FakeContext(pkgs2)
+// FakeContext : replacement for buildutil.FakeContext (go/packages needs real files)
+func FakeContext(pkgs2 map[string]map[string]string) fakeGopath {
+	return fakeGopath(pkgs2)
+}
 
-	// fix golang.org/x/tools/go/buildutil/fakecontext.go's readdir
-	originalReadDir := ctxt.ReadDir
-	clean := func(filename string) string {
-		f := path.Clean(filepath.ToSlash(filename))
-		// Removing "/go/src" while respecting segment
-		// boundaries has this unfortunate corner case:
-		if f == "/go/src" {
-			return ""
-		}
-		return strings.TrimPrefix(f, "/go/src/")
+// fakeGopath : GOPATH tree, materialized in temporary directory
+type fakeGopath map[string]map[string]string
+
+// Setup writes files, and returns build context and GOPATH directory
+func (pkgs fakeGopath) Setup(t *testing.T) (*build.Context, string) {
+	dir, err := ioutil.TempDir("", "gomvpkg-light")
+	if err != nil {
+		t.Fatal(err)
 	}
-	ctxt.ReadDir = func(dir string) ([]os.FileInfo, error) {
-		fis, err := originalReadDir(dir)
-		pkg := clean(dir)
-		for pkgname := range pkgs2 {
-			if pkgname == pkg {
-				continue
-			}
-			if strings.HasPrefix(pkgname, pkg+"/") {
-				fis = append(fis, fakeDirInfo(strings.TrimPrefix(pkgname, pkg)))
+	for path, files := range pkgs {
+		pkgdir := filepath.Join(dir, "src", filepath.FromSlash(path))
+		if err := os.MkdirAll(pkgdir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for name, contents := range files {
+			if err := ioutil.WriteFile(filepath.Join(pkgdir, name), []byte(contents), 0644); err != nil {
+				t.Fatal(err)
 			}
 		}
-		return fis, err
 	}
-	return ctxt
+
+	ctxt := build.Recursively()
+	octxt := *ctxt.Ctxt
+	octxt.GOPATH = dir
+	octxt.Dir = dir
+	ctxt.Ctxt = &octxt
+	return ctxt, dir
 }
 
 func TestMoves(t *testing.T) {
 	// from: golang.org/x/tools/refactor/rename/mvpkg_test.go
 	tests := []struct {
-		ctxt         *build.OriginalContext
+		ctxt         fakeGopath
+		wd           string // working directory (relative path from $GOPATH/src)
 		from, to, in string
+		name         string // the package name after moving (if to is same as from, only renamed)
 		want         map[string]string
 	}{
 		// Simple example.
 		{
 			ctxt: fakeContext(map[string][]string{
 				"foo": {`package foo; type T int`},
-				"bar": {`package bar`},
 				"main": {`package main
 
 import "foo"
@@ -103,6 +105,50 @@ type T int
 			},
 		},
 
+		// Renaming the package clause only (the aliased import is not changed).
+		{
+			ctxt: fakeContext(map[string][]string{
+				"foo":     {`package foo; type T int`},
+				"foo/sub": {`package sub; import "foo"; var _ foo.T`},
+				"main": {`package main
+
+import "foo"
+
+var _ foo.T
+`, `package main
+
+import f "foo"
+
+var _ f.T
+`},
+			}),
+			from: "foo", to: "foo", in: "", name: "bar",
+			want: map[string]string{
+				"/go/src/foo/0.go": `package bar
+
+type T int
+`,
+				"/go/src/foo/sub/0.go": `package sub
+
+import "foo"
+
+var _ bar.T
+`,
+				"/go/src/main/0.go": `package main
+
+import "foo"
+
+var _ bar.T
+`,
+				"/go/src/main/1.go": `package main
+
+import f "foo"
+
+var _ f.T
+`,
+			},
+		},
+
 		// Example with subpackage.
 		{
 			ctxt: fakeContext(map[string][]string{
@@ -177,6 +223,38 @@ var _ a.T
 			},
 		},
 
+		// Sibling packages sharing a prefix are not touched
+		{
+			ctxt: fakeContext(map[string][]string{
+				"foo/bar":    {`package bar; type T int`},
+				"foo/barbaz": {`package barbaz; type T int`},
+				"main": {`package main
+
+import "foo/bar"
+import "foo/barbaz"
+
+var _ bar.T
+var _ barbaz.T
+`},
+			}),
+			from: "foo/bar", to: "foo/qux", in: "",
+			want: map[string]string{
+				"/go/src/main/0.go": `package main
+
+import "foo/qux"
+import "foo/barbaz"
+
+var _ qux.T
+var _ barbaz.T
+`,
+				"/go/src/foo/qux/0.go": `package qux
+
+type T int
+`,
+				"/go/src/foo/barbaz/0.go": `package barbaz; type T int`,
+			},
+		},
+
 		// External test packages
 		{
 			ctxt: FakeContext(map[string]map[string]string{
@@ -208,21 +286,21 @@ var _ bar.T
 `,
 			},
 		},
-		// package import comments
+		// package import comments (go list checks it in GOPATH mode, so it is matched with the directory)
 		{
-			ctxt: fakeContext(map[string][]string{"foo": {`package foo // import "baz"`}}),
+			ctxt: fakeContext(map[string][]string{"foo": {`package foo // import "foo"`}}),
 			from: "foo", to: "bar", in: "foo",
 			want: map[string]string{"/go/src/bar/0.go": `package bar // import "bar"
 `},
 		},
 		{
-			ctxt: fakeContext(map[string][]string{"foo": {`package foo /* import "baz" */`}}),
+			ctxt: fakeContext(map[string][]string{"foo": {`package foo /* import "foo" */`}}),
 			from: "foo", to: "bar", in: "foo",
 			want: map[string]string{"/go/src/bar/0.go": `package bar /* import "bar" */
 `},
 		},
 		{
-			ctxt: fakeContext(map[string][]string{"foo": {`package foo       // import "baz"`}}),
+			ctxt: fakeContext(map[string][]string{"foo": {`package foo       // import "foo"`}}),
 			from: "foo", to: "bar", in: "foo",
 			want: map[string]string{"/go/src/bar/0.go": `package bar // import "bar"
 `},
@@ -245,7 +323,7 @@ var _ bar.T
 /* import " this is not an import comment */
 `},
 		},
-		// Import name conflict generates a warning, not an error.
+		// Import name conflict is resolved by aliasing.
 		{
 			ctxt: fakeContext(map[string][]string{
 				"x": {},
@@ -275,21 +353,16 @@ var _ a.B
 				"/go/src/conflict/0.go": `package conflict
 
 import "a"
-import "x/a"
+import a2 "x/a"
 
 var _ a.A
-var _ b.B
+var _ a2.B
 `,
 				"/go/src/x/a/0.go": `package a
 
 type B int
 `,
 			},
-			// wantWarnings: []string{
-			// 	`/go/src/conflict/0.go:4:8: renaming this imported package name "b" to "a"`,
-			// 	`/go/src/conflict/0.go:3:8: 	conflicts with imported package name in same block`,
-			// 	`/go/src/conflict/0.go:3:8: skipping update of this file`,
-			// },
 		},
 		// Rename with same base name.
 		{
@@ -316,84 +389,2066 @@ var _ foo.T
 `,
 			},
 		},
-	}
-	for _, test := range tests {
-		test := test
-		ctxt := build.Recursively()
-		ctxt.Ctxt = test.ctxt
+		// Named imports (memo in move.AffectedPackages, the unnamed import is "Simple example")
+		// - named import -> don't need to replace
+		{
+			ctxt: fakeContext(map[string][]string{
+				"foo": {`package foo; type T int`},
+				"main": {`package main
 
-		got := make(map[string]string)
-		// Populate got with starting file set. rewriteFile and moveDirectory
-		// will mutate got to produce resulting file set.
-		buildutil.ForEachPackage(test.ctxt, func(importPath string, err error) {
-			if err != nil {
-				return
-			}
-			path := filepath.Join("/go/src", importPath, "0.go")
-			if !buildutil.FileExists(test.ctxt, path) {
-				return
-			}
-			f, err := test.ctxt.OpenFile(path)
-			if err != nil {
-				t.Errorf("unexpected error opening file: %s", err)
-				return
-			}
-			bytes, err := ioutil.ReadAll(f)
-			f.Close()
-			if err != nil {
-				t.Errorf("unexpected error reading file: %s", err)
-				return
-			}
-			got[path] = string(bytes)
-		})
+import f "foo"
 
-		ctxt.WriteFile = func(filename string, content []byte) error {
-			got[filename] = string(content)
-			return nil
-		}
-		ctxt.MkdirAll = func(path string) error {
-			return nil
-		}
-		ctxt.MoveFile = func(from, to string) error {
-			for path, contents := range got {
-				if !(strings.HasPrefix(path, from) &&
-					(len(path) == len(from) || path[len(from)] == filepath.Separator)) {
-					continue
-				}
-				newPath := strings.Replace(path, from, to, 1)
-				delete(got, path)
-				got[newPath] = contents
-			}
-			return nil
-		}
+var _ f.T
+`},
+			}),
+			from: "foo", to: "x/bar", in: "main",
+			want: map[string]string{
+				"/go/src/main/0.go": `package main
 
-		err := run(ctxt, &option{fromPkg: test.from, toPkg: test.to, inPkg: test.in})
-		prefix := fmt.Sprintf("-from %q -to %q", test.from, test.to)
+import f "x/bar"
 
-		if err != nil {
-			t.Errorf("%s: unexpected error: %s", prefix, err)
-			continue
-		}
+var _ f.T
+`,
+				"/go/src/x/bar/0.go": `package bar
 
-		for file, wantContent := range test.want {
-			k := filepath.FromSlash(file)
-			gotContent, ok := got[k]
-			delete(got, k)
-			if !ok {
-				// TODO(matloob): some testcases might have files that won't be
-				// rewritten
-				t.Errorf("%s: file %s not rewritten", prefix, file)
-				continue
-			}
-			if gotContent != wantContent {
-				t.Errorf("%s: rewritten file %s does not match expectation; got <<<%s>>>\n"+
-					"want <<<%s>>>", prefix, file, gotContent, wantContent)
-			}
-		}
+type T int
+`,
+			},
+		},
+		// - named import, but same name of calculated from frompkg -> replace (the redundant name is dropped)
+		{
+			ctxt: fakeContext(map[string][]string{
+				"foo": {`package foo; type T int`},
+				"main": {`package main
 
-		// got should now be empty
-		for file := range got {
-			t.Errorf("%s: unexpected rewrite of file %s", prefix, file)
-		}
-	}
+import foo "foo"
+
+var _ foo.T
+`},
+			}),
+			from: "foo", to: "bar", in: "main",
+			want: map[string]string{
+				"/go/src/main/0.go": `package main
+
+import "bar"
+
+var _ bar.T
+`,
+				"/go/src/bar/0.go": `package bar
+
+type T int
+`,
+			},
+		},
+		// - another same name import is existed -> conflict
+		{
+			ctxt: fakeContext(map[string][]string{
+				"foo":   {`package foo; type T int`},
+				"y/bar": {`package bar; type S int`},
+				"main": {`package main
+
+import "foo"
+import "y/bar"
+
+var _ foo.T
+var _ bar.S
+`},
+			}),
+			from: "foo", to: "x/bar", in: "main",
+			want: map[string]string{
+				"/go/src/main/0.go": `package main
+
+import bar2 "x/bar"
+import "y/bar"
+
+var _ bar2.T
+var _ bar.S
+`,
+				"/go/src/x/bar/0.go": `package bar
+
+type T int
+`,
+				"/go/src/y/bar/0.go": `package bar; type S int`,
+			},
+		},
+		// - another same name import is existed (the package name differs from the path, e.g. /v2) -> conflict
+		{
+			ctxt: fakeContext(map[string][]string{
+				"foo":  {`package foo; type T int`},
+				"y/v2": {`package bar; type S int`},
+				"main": {`package main
+
+import "foo"
+import "y/v2"
+
+var _ foo.T
+var _ bar.S
+`},
+			}),
+			from: "foo", to: "x/bar", in: "main",
+			want: map[string]string{
+				"/go/src/main/0.go": `package main
+
+import bar2 "x/bar"
+import "y/v2"
+
+var _ bar2.T
+var _ bar.S
+`,
+				"/go/src/x/bar/0.go": `package bar
+
+type T int
+`,
+				"/go/src/y/v2/0.go": `package bar; type S int`,
+			},
+		},
+		// - another same name import is existed (named import) -> conflict
+		{
+			ctxt: fakeContext(map[string][]string{
+				"foo": {`package foo; type T int`},
+				"y/s": {`package s; type S int`},
+				"main": {`package main
+
+import "foo"
+import bar "y/s"
+
+var _ foo.T
+var _ bar.S
+`},
+			}),
+			from: "foo", to: "x/bar", in: "main",
+			want: map[string]string{
+				"/go/src/main/0.go": `package main
+
+import bar2 "x/bar"
+import bar "y/s"
+
+var _ bar2.T
+var _ bar.S
+`,
+				"/go/src/x/bar/0.go": `package bar
+
+type T int
+`,
+				"/go/src/y/s/0.go": `package s; type S int`,
+			},
+		},
+
+		// Shadowing of the new name: local variable
+		{
+			ctxt: fakeContext(map[string][]string{
+				"foo": {`package foo; type T int`},
+				"main": {`package main
+
+import "foo"
+
+func f() {
+	bar := 1
+	var _ foo.T = foo.T(bar)
+}
+`},
+			}),
+			from: "foo", to: "bar", in: "main",
+			want: map[string]string{
+				"/go/src/main/0.go": `package main
+
+import bar2 "bar"
+
+func f() {
+	bar := 1
+	var _ bar2.T = bar2.T(bar)
+}
+`,
+				"/go/src/bar/0.go": `package bar
+
+type T int
+`,
+			},
+		},
+		// Shadowing of the new name: parameter (and the not shadowed file)
+		{
+			ctxt: fakeContext(map[string][]string{
+				"foo": {`package foo; type T int`},
+				"main": {`package main
+
+import "foo"
+
+func f(bar int) foo.T {
+	return foo.T(bar)
+}
+`, `package main
+
+import "foo"
+
+func g() foo.T {
+	return 0
+}
+`},
+			}),
+			from: "foo", to: "bar", in: "main",
+			want: map[string]string{
+				"/go/src/main/0.go": `package main
+
+import bar2 "bar"
+
+func f(bar int) bar2.T {
+	return bar2.T(bar)
+}
+`,
+				"/go/src/main/1.go": `package main
+
+import "bar"
+
+func g() bar.T {
+	return 0
+}
+`,
+				"/go/src/bar/0.go": `package bar
+
+type T int
+`,
+			},
+		},
+		// Shadowing of the new name: package-level declaration
+		{
+			ctxt: fakeContext(map[string][]string{
+				"foo": {`package foo; type T int`},
+				"main": {`package main
+
+import "foo"
+
+var _ foo.T
+`, `package main
+
+var bar int
+`},
+			}),
+			from: "foo", to: "bar", in: "main",
+			want: map[string]string{
+				"/go/src/main/0.go": `package main
+
+import bar2 "bar"
+
+var _ bar2.T
+`,
+				"/go/src/main/1.go": `package main
+
+var bar int
+`,
+				"/go/src/bar/0.go": `package bar
+
+type T int
+`,
+			},
+		},
+
+		// Go modules
+		{
+			ctxt: FakeContext(map[string]map[string]string{
+				"work":     {"go.mod": "module example.com/m\n\ngo 1.16\n"},
+				"work/foo": {"0.go": `package foo; type T int`},
+				"work/main": {"0.go": `package main
+
+import "example.com/m/foo"
+
+var _ foo.T
+`},
+			}),
+			wd:   "work/main",
+			from: "example.com/m/foo", to: "example.com/m/bar", in: "",
+			want: map[string]string{
+				"/go/src/work/go.mod": "module example.com/m\n\ngo 1.16\n",
+				"/go/src/work/main/0.go": `package main
+
+import "example.com/m/bar"
+
+var _ bar.T
+`,
+				"/go/src/work/bar/0.go": `package bar
+
+type T int
+`,
+			},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		// the syntactic mode and the streaming mode must produce the same result
+		for _, mode := range []option{{}, {syntactic: true}, {batch: 1}} {
+			ctxt, dir := test.ctxt.Setup(t)
+			defer os.RemoveAll(dir)
+			if test.wd != "" {
+				ctxt.Ctxt.Dir = filepath.Join(dir, "src", test.wd)
+			}
+
+			// "/tmp/xxx/src/foo/0.go" -> "/go/src/foo/0.go"
+			virtual := func(path string) string {
+				return "/go" + strings.TrimPrefix(path, dir)
+			}
+
+			got := make(map[string]string)
+			// Populate got with starting file set. rewriteFile and moveDirectory
+			// will mutate got to produce resulting file set.
+			filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				bytes, err := ioutil.ReadFile(path)
+				if err != nil {
+					t.Errorf("unexpected error reading file: %s", err)
+					return nil
+				}
+				got[virtual(path)] = string(bytes)
+				return nil
+			})
+
+			ctxt.WriteFile = func(filename string, content []byte) error {
+				got[virtual(filename)] = string(content)
+				return nil
+			}
+			ctxt.MkdirAll = func(path string) error {
+				return nil
+			}
+			ctxt.MoveFile = func(from, to string) error {
+				from, to = virtual(from), virtual(to)
+				for path, contents := range got {
+					if !(strings.HasPrefix(path, from) &&
+						(len(path) == len(from) || path[len(from)] == filepath.Separator)) {
+						continue
+					}
+					newPath := strings.Replace(path, from, to, 1)
+					delete(got, path)
+					got[newPath] = contents
+				}
+				return nil
+			}
+
+			mode.fromPkg, mode.toPkg, mode.inPkg, mode.name = test.from, test.to, test.in, test.name
+			err := run(ctxt, &mode)
+			prefix := fmt.Sprintf("-from %q -to %q", test.from, test.to)
+			if mode.syntactic {
+				prefix += " -syntactic"
+			}
+			if mode.batch > 0 {
+				prefix += fmt.Sprintf(" -batch %d", mode.batch)
+			}
+
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", prefix, err)
+				continue
+			}
+
+			for file, wantContent := range test.want {
+				k := filepath.FromSlash(file)
+				gotContent, ok := got[k]
+				delete(got, k)
+				if !ok {
+					// TODO(matloob): some testcases might have files that won't be
+					// rewritten
+					t.Errorf("%s: file %s not rewritten", prefix, file)
+					continue
+				}
+				if gotContent != wantContent {
+					t.Errorf("%s: rewritten file %s does not match expectation; got <<<%s>>>\n"+
+						"want <<<%s>>>", prefix, file, gotContent, wantContent)
+				}
+			}
+
+			// got should now be empty
+			for file := range got {
+				t.Errorf("%s: unexpected rewrite of file %s", prefix, file)
+			}
+		}
+	}
+}
+
+func TestTargetRoot(t *testing.T) {
+	ctxt, dir := FakeContext(map[string]map[string]string{
+		"work":     {"go.mod": "module example.com/m\n\ngo 1.16\n"},
+		"work/foo": {"0.go": `package foo`},
+		"main":     {"0.go": `package main`},
+	}).Setup(t)
+	defer os.RemoveAll(dir)
+	ctxt.Ctxt.Dir = filepath.Join(dir, "src", "work", "foo")
+	work := filepath.Join(dir, "src", "work")
+
+	// resolved via go.mod (the working directory is placed in the module)
+	root, err := collect.TargetRoot(ctxt, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Pkg != "example.com/m" || root.Path != work || root.Module == nil {
+		t.Errorf("module root does not match expectation; got %+v", root)
+	}
+	foo, err := collect.TargetRoot(ctxt, "example.com/m/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(work, "foo"); foo.Path != want {
+		t.Errorf("module package does not match expectation; got %s, want %s", foo.Path, want)
+	}
+	if got, want := root.ImportPath(foo.Path), "example.com/m/foo"; got != want {
+		t.Errorf("import path does not match expectation; got %s, want %s", got, want)
+	}
+	if bar, err := collect.NewTarget(ctxt, foo, "example.com/m/bar"); err != nil || bar.Path != filepath.Join(work, "bar") || !bar.NeedCreate {
+		t.Errorf("new module package does not match expectation; got %+v (%v)", bar, err)
+	}
+	if _, err := collect.NewTarget(ctxt, foo, "example.com/other/bar"); err == nil {
+		t.Errorf("new package outside of the module is accepted")
+	}
+	if _, err := collect.TargetRoot(ctxt, "example.com/m/missing"); err == nil {
+		t.Errorf("missing package in the module is found")
+	}
+
+	// not found go.mod, GOPATH mode
+	ctxt.Ctxt.Dir = filepath.Join(dir, "src", "main")
+	main, err := collect.TargetRoot(ctxt, "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if main.Module != nil || main.Path != filepath.Join(dir, "src", "main") {
+		t.Errorf("GOPATH package does not match expectation; got %+v", main)
+	}
+	if got, want := main.ImportPath(filepath.Join(dir, "src", "main", "sub")), "main/sub"; got != want {
+		t.Errorf("import path does not match expectation; got %s, want %s", got, want)
+	}
+
+	// unreadable go.mod is not treated as missing
+	ctxt.Ctxt.Dir = filepath.Join(dir, "src", "work", "foo")
+	ctxt.Ctxt.OpenFile = func(path string) (io.ReadCloser, error) {
+		if filepath.Base(path) == "go.mod" {
+			return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrPermission}
+		}
+		return os.Open(path)
+	}
+	if _, err := collect.TargetRoot(ctxt, ""); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("unreadable go.mod is not reported; got %v", err)
+	}
+}
+
+func TestAffectedPackagesJobs(t *testing.T) {
+	pkgs := map[string][]string{
+		"foo": {`package foo; type T int`},
+	}
+	for i := 0; i < 30; i++ {
+		pkg := fmt.Sprintf("p%02d", i)
+		switch i % 3 {
+		case 0:
+			pkgs[pkg] = []string{fmt.Sprintf(`package %s; import "foo"; var _ foo.T`, pkg)}
+		case 1:
+			pkgs[pkg] = []string{fmt.Sprintf(`package %s; import "fmt"; var _ = fmt.Sprint`, pkg), fmt.Sprintf(`package %s; import "foo/sub"`, pkg)}
+		case 2:
+			pkgs[pkg+"/x"] = []string{fmt.Sprintf(`package %s_test; import "foo"; var _ foo.T`, pkg)}
+		}
+	}
+	ctxt, dir := fakeContext(pkgs).Setup(t)
+	defer os.RemoveAll(dir)
+
+	root, err := collect.TargetRoot(ctxt, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgdirs, err := collect.GoFilesDirectories(context.Background(), ctxt, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the result is not changed by the number of workers (same order)
+	scan := func(jobs int) string {
+		ctxt.Jobs = jobs
+		affected, err := collect.AffectedPackages(ctxt, "foo", root, pkgdirs, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		for _, a := range affected {
+			fmt.Fprintf(&b, "%s %s %s %v %v\n", a.Pkg, a.Name, a.Dir, a.Files, a.IsXTest)
+		}
+		return b.String()
+	}
+	want := scan(1)
+	if n := strings.Count(want, "\n"); n != 30 {
+		t.Fatalf("the number of affected packages does not match expectation; got %d, want 30\n%s", n, want)
+	}
+	for i := 0; i < 5; i++ {
+		if got := scan(8); got != want {
+			t.Fatalf("affected packages do not match (jobs=8); got <<<%s>>>\nwant (jobs=1) <<<%s>>>", got, want)
+		}
+	}
+}
+
+func TestGoFilesDirectoriesOrder(t *testing.T) {
+	ctxt, dir := fakeContext(map[string][]string{
+		"r":         {`package r`},
+		"r/b":       {`package b`},
+		"r/a":       {`package a`},
+		"r/a/c":     {`package c`},
+		"r/a/c/d/e": {`package e`},
+		"r/b/a":     {`package a`},
+	}).Setup(t)
+	defer os.RemoveAll(dir)
+	ctxt.Jobs = 8
+
+	root, err := collect.TargetRoot(ctxt, "r")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sorted (not the order of walking)
+	var want []string
+	for _, path := range []string{"r", "r/a", "r/a/c", "r/a/c/d/e", "r/b", "r/b/a"} {
+		want = append(want, filepath.Join(dir, "src", filepath.FromSlash(path)))
+	}
+	for i := 0; i < 5; i++ {
+		got, err := collect.GoFilesDirectories(context.Background(), ctxt, root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("candidate directories do not match expectation; got %v\nwant %v", got, want)
+		}
+	}
+
+	// cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := collect.GoFilesDirectories(ctx, ctxt, root); err != context.Canceled {
+		t.Errorf("cancelled walking must return %v; got %v", context.Canceled, err)
+	}
+}
+
+func TestGoFilesDirectories(t *testing.T) {
+	ctxt, dir := FakeContext(map[string]map[string]string{
+		"app": {
+			"main.go":        `package main`,
+			".gomvpkgignore": "# generated code\ngen\nsub/*_old\n",
+		},
+		"app/sub":         {"sub.go": `package sub`},
+		"app/sub/x_old":   {"x.go": `package x`},
+		"app/sub/y":       {"y.go": `package y`},
+		"app/gen/z":       {"z.go": `package z`},
+		"app/vendor/v":    {"v.go": `package v`},
+		"app/testdata":    {"t.go": `package t`},
+		"app/_unused":     {"u.go": `package u`},
+		"app/.hidden":     {"h.go": `package h`},
+		"app/nogo":        {"README": ``},
+		"app/nogo/deeper": {"d.go": `package deeper`},
+		"app/tools":       {"go.mod": "module example.com/tools\n", "tools.go": `package tools`},
+		"app/tools/sub":   {"s.go": `package sub`},
+	}).Setup(t)
+	defer os.RemoveAll(dir)
+
+	root, err := collect.TargetRoot(ctxt, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := collect.GoFilesDirectories(context.Background(), ctxt, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want []string
+	for _, path := range []string{"app", "app/nogo/deeper", "app/sub", "app/sub/y"} {
+		want = append(want, filepath.Join(dir, "src", filepath.FromSlash(path)))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("candidate directories do not match expectation; got %v\nwant %v", got, want)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	ctxt, dir := fakeContext(map[string][]string{
+		"foo":  {`package foo; type T int`},
+		"main": {`package main; import "foo"; var _ foo.T`},
+		"sub":  {`package sub; import "fmt"; var _ = fmt.Sprint`},
+	}).Setup(t)
+	defer os.RemoveAll(dir)
+
+	root, err := collect.TargetRoot(ctxt, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgdirs, err := collect.GoFilesDirectories(context.Background(), ctxt, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := collect.IndexPath(filepath.Join(dir, "cache"), root)
+
+	affectedPkgs := func() []string {
+		idx, err := collect.OpenIndex(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		affected, err := collect.AffectedPackages(ctxt, "foo", root, pkgdirs, idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := idx.Save(); err != nil {
+			t.Fatal(err)
+		}
+		var pkgs []string
+		for _, a := range affected {
+			pkgs = append(pkgs, a.Pkg)
+		}
+		return pkgs
+	}
+
+	if got, want := fmt.Sprint(affectedPkgs()), "[main]"; got != want {
+		t.Fatalf("affected packages do not match expectation; got %s, want %s", got, want)
+	}
+
+	// same size and mtime, the cached imports are used
+	filename := filepath.Join(dir, "src/sub/0.go")
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, []byte(`package sub; import "foo"; var _ = foo.T(100)`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filename, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(affectedPkgs()), "[main]"; got != want {
+		t.Errorf("unchanged file is rescanned; got %s, want %s", got, want)
+	}
+
+	// changed, rescanned
+	mtime := info.ModTime().Add(time.Second)
+	if err := os.Chtimes(filename, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(affectedPkgs()), "[main sub]"; got != want {
+		t.Errorf("changed file is not rescanned; got %s, want %s", got, want)
+	}
+}
+
+func TestSyntactic(t *testing.T) {
+	ctxt, dir := FakeContext(map[string]map[string]string{
+		"foo": {
+			"foo.go":      `package foo; type T int`,
+			"foo_test.go": "package foo_test\n\nimport \"foo\"\n\nfunc f(bar int) foo.T { return foo.T(bar) }\n",
+		},
+		"main": {
+			"main.go": "package main\n\nimport \"foo\"\n\nfunc f(foo int) int { return foo }\n\nvar _ foo.T\n",
+		},
+		"shadow": {
+			"shadow.go": "package shadow\n\nimport \"foo\"\n\nvar _ foo.T\n",
+			"decl.go":   "package shadow\n\nvar bar int\n",
+		},
+	}).Setup(t)
+	defer os.RemoveAll(dir)
+
+	root, err := collect.TargetRoot(ctxt, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := collect.TargetRoot(ctxt, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := collect.NewTarget(ctxt, src, "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgdirs, err := collect.GoFilesDirectories(context.Background(), ctxt, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	affected, err := collect.AffectedPackages(ctxt, "foo", root, pkgdirs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fset := token.NewFileSet()
+	req := &move.Req{
+		FromPkg:     "foo",
+		ToPkg:       "bar",
+		Root:        root,
+		Affected:    affected,
+		WillBeWrite: map[*token.File]*move.PreWrite{},
+	}
+	var typechecked []string
+	s := &move.Syntactic{
+		Ctxt: ctxt,
+		Fset: fset,
+		Src:  src,
+		Dst:  dst,
+		TypeCheck: func(pkgs []string) (*load.Program, error) {
+			typechecked = append(typechecked, pkgs...)
+			c := &load.Config{Fset: fset}
+			return c.Load(ctxt, root, append([]string{"foo"}, pkgs...))
+		},
+	}
+	if err := s.TargetPackage(req); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AffectedPackages(req); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the packages including ambiguous files are type checked
+	if got, want := fmt.Sprint(typechecked), "[foo shadow]"; got != want {
+		t.Errorf("type checked packages do not match expectation; got %s, want %s", got, want)
+	}
+
+	want := map[string]string{
+		"foo/foo.go":       "package bar\n\ntype T int\n",
+		"foo/foo_test.go":  "package bar_test\n\nimport bar2 \"bar\"\n\nfunc f(bar int) bar2.T { return bar2.T(bar) }\n",
+		"main/main.go":     "package main\n\nimport \"bar\"\n\nfunc f(foo int) int { return foo }\n\nvar _ bar.T\n",
+		"shadow/shadow.go": "package shadow\n\nimport bar2 \"bar\"\n\nvar _ bar2.T\n",
+	}
+	got := map[string]string{}
+	for _, f := range req.SortedFiles() {
+		var b bytes.Buffer
+		if err := format.Node(&b, fset, req.WillBeWrite[f].File); err != nil {
+			t.Fatal(err)
+		}
+		rel, _ := filepath.Rel(filepath.Join(dir, "src"), f.Name())
+		got[filepath.ToSlash(rel)] = b.String()
+	}
+	for file, wantContent := range want {
+		if gotContent, ok := got[file]; !ok {
+			t.Errorf("file %s not rewritten", file)
+		} else if gotContent != wantContent {
+			t.Errorf("rewritten file %s does not match expectation; got <<<%s>>>\nwant <<<%s>>>", file, gotContent, wantContent)
+		}
+		delete(got, file)
+	}
+	for file := range got {
+		t.Errorf("unexpected rewrite of file %s", file)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		msg     string
+		ctxt    fakeGopath
+		batch   int
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			msg: "importers of both packages are collapsed",
+			ctxt: FakeContext(map[string]map[string]string{
+				"foo": {"foo.go": `package foo
+
+import "bar"
+
+type T bar.U
+`},
+				"bar": {"bar.go": `package bar
+
+type U int
+`},
+				"main": {"main.go": `package main
+
+import (
+	"bar"
+	f "foo"
+)
+
+var _ f.T
+var _ bar.U
+`},
+				"sub": {"sub.go": `package sub
+
+import "foo"
+
+var _ foo.T
+`},
+			}),
+			want: map[string]string{
+				"bar/foo.go": `package bar
+
+type T U
+`,
+				"bar/bar.go": `package bar
+
+type U int
+`,
+				"main/main.go": `package main
+
+import (
+	"bar"
+)
+
+var _ bar.T
+var _ bar.U
+`,
+				"sub/sub.go": `package sub
+
+import "bar"
+
+var _ bar.T
+`,
+			},
+		},
+		{
+			msg: "the destination importing the source",
+			ctxt: FakeContext(map[string]map[string]string{
+				"foo": {"foo.go": `package foo
+
+type T int
+`},
+				"bar": {"bar.go": `package bar
+
+import "foo"
+
+type U foo.T
+`},
+			}),
+			want: map[string]string{
+				"bar/foo.go": `package bar
+
+type T int
+`,
+				"bar/bar.go": `package bar
+
+type U T
+`,
+			},
+		},
+		{
+			msg: "the destination importing the source (streaming)",
+			ctxt: FakeContext(map[string]map[string]string{
+				"foo": {"foo.go": `package foo
+
+type T int
+`},
+				"bar": {"bar.go": `package bar
+
+import "foo"
+
+type U foo.T
+`},
+				"main": {"main.go": `package main
+
+import "foo"
+
+var _ foo.T
+`},
+			}),
+			batch: 1,
+			want: map[string]string{
+				"bar/foo.go": `package bar
+
+type T int
+`,
+				"bar/bar.go": `package bar
+
+type U T
+`,
+				"main/main.go": `package main
+
+import "bar"
+
+var _ bar.T
+`,
+			},
+		},
+		{
+			msg: "the destination directory without go files (moved into it)",
+			ctxt: FakeContext(map[string]map[string]string{
+				"foo": {"foo.go": `package foo
+
+type T int
+`},
+				"bar": {"README.md": "assets only\n"},
+				"main": {"main.go": `package main
+
+import "foo"
+
+var _ foo.T
+`},
+			}),
+			want: map[string]string{
+				"bar/foo.go": `package bar
+
+type T int
+`,
+				"bar/README.md": "assets only\n",
+				"main/main.go": `package main
+
+import "bar"
+
+var _ bar.T
+`,
+			},
+		},
+		{
+			msg: "importers of both packages, the collapsed name is shadowed (nothing is written)",
+			ctxt: FakeContext(map[string]map[string]string{
+				"foo": {"foo.go": `package foo
+
+type T int
+`},
+				"bar": {"bar.go": `package bar
+
+type U int
+`},
+				"main": {"main.go": `package main
+
+import (
+	"bar"
+	"foo"
+)
+
+var _ bar.U
+
+func f(bar int) foo.T { return foo.T(bar) }
+`},
+			}),
+			wantErr: `shadowed: bar is declared (in main/main.go), the imports of "foo" and "bar" cannot be collapsed`,
+		},
+		{
+			msg: "duplicate declarations",
+			ctxt: FakeContext(map[string]map[string]string{
+				"foo": {"foo.go": `package foo; type T int`},
+				"bar": {"bar.go": `package bar; type T string`},
+			}),
+			wantErr: "cannot merge, 1 conflicts are found",
+		},
+		{
+			msg: "import names and the top-level declarations of the other package",
+			ctxt: FakeContext(map[string]map[string]string{
+				"foo": {"foo.go": `package foo
+
+import "strings"
+
+var _ = strings.TrimSpace
+
+func fmt() {}
+`},
+				"bar": {"bar.go": `package bar
+
+import "fmt"
+
+var _ = fmt.Sprint
+
+var strings = 1
+`},
+			}),
+			wantErr: "cannot merge, 2 conflicts are found",
+		},
+		{
+			msg: "file name collisions",
+			ctxt: FakeContext(map[string]map[string]string{
+				"foo": {"x.go": `package foo; type T int`},
+				"bar": {"x.go": `package bar; type U int`},
+			}),
+			wantErr: "cannot merge, 1 conflicts are found",
+		},
+		{
+			msg: "the reference to the destination is shadowed by a local variable",
+			ctxt: FakeContext(map[string]map[string]string{
+				"foo": {"foo.go": `package foo
+
+import "bar"
+
+func F() int { U := 1; return U + int(bar.U) }
+`},
+				"bar": {"bar.go": `package bar
+
+const U = 2
+`},
+			}),
+			wantErr: "cannot merge, 1 conflicts are found",
+		},
+		{
+			msg: "the reference to the source is shadowed by a parameter",
+			ctxt: FakeContext(map[string]map[string]string{
+				"foo": {"foo.go": `package foo
+
+type T int
+`},
+				"bar": {"bar.go": `package bar
+
+import "foo"
+
+func G(T int) foo.T { return foo.T(T) }
+`},
+			}),
+			wantErr: "cannot merge, 1 conflicts are found", // the result type is out of the parameter's scope
+		},
+	}
+	for _, test := range tests {
+		ctxt, dir := test.ctxt.Setup(t)
+		defer os.RemoveAll(dir)
+
+		err := run(ctxt, &option{fromPkg: "foo", toPkg: "bar", inPkg: "", batch: test.batch})
+		if !checkFiles(t, test.msg, test.ctxt, dir, err, test.want, test.wantErr) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, "src/foo")); err == nil && test.wantErr == "" {
+			t.Errorf("%s: the source directory is left", test.msg)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		msg     string
+		ctxt    fakeGopath
+		files   string
+		decls   string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			msg: "importers and the remaining files refer to the new package",
+			ctxt: FakeContext(map[string]map[string]string{
+				"foo": {
+					"a.go": `package foo
+
+type A int
+
+func NewA() A { return A(1) }
+`,
+					"b.go": `package foo
+
+type B struct {
+	X A
+}
+`},
+				"main": {
+					"main.go": `package main
+
+import "foo"
+
+var _ foo.A = foo.NewA()
+var _ foo.B
+`,
+					"only.go": `package main
+
+import (
+	"fmt"
+
+	"foo"
+)
+
+func use() { fmt.Println(foo.NewA()) }
+`},
+			}),
+			files: "a.go",
+			want: map[string]string{
+				"bar/a.go": `package bar
+
+type A int
+
+func NewA() A { return A(1) }
+`,
+				"foo/b.go": `package foo
+
+import "bar"
+
+type B struct {
+	X bar.A
+}
+`,
+				"main/main.go": `package main
+
+import (
+	"foo"
+	"bar"
+)
+
+var _ bar.A = bar.NewA()
+var _ foo.B
+`,
+				"main/only.go": `package main
+
+import (
+	"fmt"
+
+	"bar"
+)
+
+func use() { fmt.Println(bar.NewA()) }
+`,
+			},
+		},
+		{
+			msg: "unexported references",
+			ctxt: FakeContext(map[string]map[string]string{
+				"foo": {
+					"a.go": `package foo; type A int; var _ = b`,
+					"b.go": `package foo; var b = 1`,
+				},
+			}),
+			files:   "a.go",
+			wantErr: "cannot split, 1 conflicts are found",
+		},
+		{
+			msg: "import cycle and methods",
+			ctxt: FakeContext(map[string]map[string]string{
+				"foo": {
+					"a.go": `package foo; type A int; var _ B`,
+					"b.go": `package foo; type B int; var _ A; func (A) M() {}`,
+				},
+			}),
+			files:   "a*.go",
+			wantErr: "cannot split, 2 conflicts are found",
+		},
+		{
+			msg: "methods of the generic type",
+			ctxt: FakeContext(map[string]map[string]string{
+				"foo": {
+					"a.go": `package foo
+
+type M[K comparable, V any] map[K]V
+
+func (m *M[K, V]) Get(k K) V { return (*m)[k] }
+`,
+					"b.go": `package foo
+
+type S[T any] []T
+
+func (s S[T]) Len() int { return len(s) }
+`,
+				},
+			}),
+			files: "a.go",
+			want: map[string]string{
+				"bar/a.go": `package bar
+
+type M[K comparable, V any] map[K]V
+
+func (m *M[K, V]) Get(k K) V { return (*m)[k] }
+`,
+				"foo/b.go": `package foo
+
+type S[T any] []T
+
+func (s S[T]) Len() int { return len(s) }
+`,
+			},
+		},
+		{
+			msg: "declarations with the unexported helpers",
+			ctxt: FakeContext(map[string]map[string]string{
+				"foo": {
+					"a.go": `package foo
+
+import "strings"
+
+// Hello : moved
+func Hello(s string) string { return normalize(s) }
+
+func normalize(s string) string { return strings.TrimSpace(s) }
+
+// Other : remaining
+func Other() string { return Hello("x") }
+`},
+				"main": {
+					"main.go": `package main
+
+import "foo"
+
+var _ = foo.Hello("x") + foo.Other()
+`},
+			}),
+			decls: "Hello",
+			want: map[string]string{
+				"bar/a.go": `package bar
+
+import "strings"
+
+// Hello : moved
+func Hello(s string) string { return normalize(s) }
+
+func normalize(s string) string { return strings.TrimSpace(s) }
+`,
+				"foo/a.go": `package foo
+
+import "bar"
+
+// Other : remaining
+func Other() string { return bar.Hello("x") }
+`,
+				"main/main.go": `package main
+
+import (
+	"foo"
+	"bar"
+)
+
+var _ = bar.Hello("x") + foo.Other()
+`,
+			},
+		},
+		{
+			msg: "declarations of the generic type (with the methods and the helpers)",
+			ctxt: FakeContext(map[string]map[string]string{
+				"foo": {
+					"a.go": `package foo
+
+type M[K comparable, V any] map[K]V
+
+func (m *M[K, V]) Get(k K) V { return lookup(*m, k) }
+
+func lookup[K comparable, V any](m map[K]V, k K) V { return m[k] }
+
+// Other : remaining
+func Other() int { return 1 }
+`},
+			}),
+			decls: "M",
+			want: map[string]string{
+				"bar/a.go": `package bar
+
+type M[K comparable, V any] map[K]V
+
+func (m *M[K, V]) Get(k K) V { return lookup(*m, k) }
+
+func lookup[K comparable, V any](m map[K]V, k K) V { return m[k] }
+`,
+				"foo/a.go": `package foo
+
+// Other : remaining
+func Other() int { return 1 }
+`,
+			},
+		},
+		{
+			msg: "the unrelated imports are kept as is (the order and the groups)",
+			ctxt: FakeContext(map[string]map[string]string{
+				"foo": {
+					"a.go": `package foo
+
+type A int
+`,
+					"b.go": `package foo
+
+type B int
+`},
+				"main": {
+					"main.go": `package main
+
+import (
+	"strings"
+	"fmt"
+
+	"foo"
+)
+
+var _ = strings.TrimSpace
+var _ = fmt.Sprint
+var _ foo.A
+var _ foo.B
+`},
+			}),
+			files: "a.go",
+			want: map[string]string{
+				"bar/a.go": `package bar
+
+type A int
+`,
+				"foo/b.go": `package foo
+
+type B int
+`,
+				"main/main.go": `package main
+
+import (
+	"strings"
+	"bar"
+	"fmt"
+
+	"foo"
+)
+
+var _ = strings.TrimSpace
+var _ = fmt.Sprint
+var _ bar.A
+var _ foo.B
+`,
+			},
+		},
+		{
+			msg: "a constant of the iota group (moved with the group)",
+			ctxt: FakeContext(map[string]map[string]string{
+				"foo": {"a.go": `package foo
+
+const (
+	A = iota
+	B
+	C
+)
+
+func Other() int { return 0 }
+`},
+			}),
+			decls: "C",
+			want: map[string]string{
+				"bar/a.go": `package bar
+
+const (
+	A = iota
+	B
+	C
+)
+`,
+				"foo/a.go": `package foo
+
+func Other() int { return 0 }
+`,
+			},
+		},
+		{
+			msg: "the first constant of the implicit repetition (the rest is referred via the import)",
+			ctxt: FakeContext(map[string]map[string]string{
+				"foo": {"a.go": `package foo
+
+const (
+	A = 1 << iota
+	B
+)
+
+func Other() int { return B }
+`},
+			}),
+			decls: "A",
+			want: map[string]string{
+				"bar/a.go": `package bar
+
+const (
+	A = 1 << iota
+	B
+)
+`,
+				"foo/a.go": `package foo
+
+import "bar"
+
+func Other() int { return bar.B }
+`,
+			},
+		},
+		{
+			msg: "an explicit iota in the group (the value is kept)",
+			ctxt: FakeContext(map[string]map[string]string{
+				"foo": {"a.go": `package foo
+
+const (
+	X = 10
+	Y = iota
+)
+
+func Other() int { return 0 }
+`},
+			}),
+			decls: "Y",
+			want: map[string]string{
+				"bar/a.go": `package bar
+
+const (
+	X = 10
+	Y = iota
+)
+`,
+				"foo/a.go": `package foo
+
+func Other() int { return 0 }
+`,
+			},
+		},
+		{
+			msg: "declarations into the existing package, the file name is existed",
+			ctxt: FakeContext(map[string]map[string]string{
+				"foo": {"a.go": `package foo
+
+func Hello() string { return "hello" }
+
+func Other() string { return "other" }
+`},
+				"bar": {"a.go": `package bar
+
+func Bye() string { return "bye" }
+`},
+			}),
+			decls: "Hello",
+			want: map[string]string{
+				"bar/a.go": `package bar
+
+func Bye() string { return "bye" }
+`,
+				"bar/foo_a.go": `package bar
+
+func Hello() string { return "hello" }
+`,
+				"foo/a.go": `package foo
+
+func Other() string { return "other" }
+`,
+			},
+		},
+		{
+			msg: "declarations into the existing package",
+			ctxt: FakeContext(map[string]map[string]string{
+				"foo": {"a.go": `package foo; type T int`},
+				"bar": {"b.go": `package bar; type T string`},
+			}),
+			decls:   "T",
+			wantErr: "cannot split, 1 conflicts are found",
+		},
+		{
+			msg: "declarations referred from the existing package, shadowed by a parameter",
+			ctxt: FakeContext(map[string]map[string]string{
+				"foo": {"a.go": `package foo
+
+const T = 1
+`},
+				"bar": {"b.go": `package bar
+
+import "foo"
+
+func G(T int) int { return T + foo.T }
+`},
+			}),
+			decls:   "T",
+			wantErr: "cannot split, 1 conflicts are found",
+		},
+		{
+			msg: "declarations referring to the existing package, shadowed by a local variable",
+			ctxt: FakeContext(map[string]map[string]string{
+				"foo": {"a.go": `package foo
+
+import "bar"
+
+func F() int { U := 1; return U + int(bar.U) }
+
+func G() int { return int(bar.U) }
+`},
+				"bar": {"b.go": `package bar
+
+const U = 2
+`},
+			}),
+			decls:   "F",
+			wantErr: "cannot split, 1 conflicts are found",
+		},
+	}
+	for _, test := range tests {
+		ctxt, dir := test.ctxt.Setup(t)
+		defer os.RemoveAll(dir)
+
+		err := runSplit(ctxt, &option{fromPkg: "foo", toPkg: "bar", files: test.files, decls: test.decls})
+		checkFiles(t, test.msg, test.ctxt, dir, err, test.want, test.wantErr)
+	}
+}
+
+// readFiles returns the contents of the files under dir (keyed by slash separated relative path)
+func readFiles(dir string) map[string]string {
+	files := map[string]string{}
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		files[filepath.ToSlash(rel)] = string(b)
+		return nil
+	})
+	return files
+}
+
+// checkFiles compares the files under dir with want, after checking err with wantErr.
+// if wantErr is not empty, nothing is written (the files of gopath are left as is).
+// returns false, if err is unexpected
+func checkFiles(t *testing.T, msg string, gopath fakeGopath, dir string, err error, want map[string]string, wantErr string) bool {
+	t.Helper()
+	if wantErr != "" {
+		if err == nil || err.Error() != wantErr {
+			t.Errorf("%s: error does not match expectation; got %v, want %s", msg, err, wantErr)
+		}
+		want = map[string]string{}
+		for pkg, files := range gopath {
+			for name, content := range files {
+				want[pkg+"/"+name] = content
+			}
+		}
+	} else if err != nil {
+		t.Errorf("%s: unexpected error: %s", msg, err)
+		return false
+	}
+
+	got := readFiles(filepath.Join(dir, "src"))
+	if len(got) != len(want) {
+		t.Errorf("%s: files do not match expectation; got %d files, want %d files", msg, len(got), len(want))
+	}
+	for file, wantContent := range want {
+		if gotContent := got[file]; gotContent != wantContent {
+			t.Errorf("%s: %s does not match expectation; got <<<%s>>>\nwant <<<%s>>>", msg, file, gotContent, wantContent)
+		}
+	}
+	return true
+}
+
+func TestDryRun(t *testing.T) {
+	ctxt, dir := fakeContext(map[string][]string{
+		"foo": {`package foo; type T int`},
+		"main": {`package main
+
+import "foo"
+
+var _ foo.T
+`},
+	}).Setup(t)
+	defer os.RemoveAll(dir)
+
+	var b bytes.Buffer
+	ctxt = build.DryRun(ctxt, &b)
+	if err := run(ctxt, &option{fromPkg: "foo", toPkg: "bar", inPkg: "main", dryRun: true}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := strings.Replace(`--- $/src/foo/0.go
++++ $/src/foo/0.go
+@@ -1,1 +1,3 @@
+-package foo; type T int
+\ No newline at end of file
++package bar
++
++type T int
+--- $/src/main/0.go
++++ $/src/main/0.go
+@@ -1,5 +1,5 @@
+ package main
+ 
+-import "foo"
++import "bar"
+ 
+-var _ foo.T
++var _ bar.T
+rename from $/src/foo
+rename to $/src/bar
+`, "$", dir, -1)
+	if got := b.String(); got != want {
+		t.Errorf("dry-run output does not match expectation; got <<<%s>>>\nwant <<<%s>>>", got, want)
+	}
+
+	// nothing is written
+	if _, err := os.Stat(filepath.Join(dir, "src/bar")); err == nil {
+		t.Errorf("unexpected creation of %s", filepath.Join(dir, "src/bar"))
+	}
+}
+
+func TestRollback(t *testing.T) {
+	ctxt, dir := fakeContext(map[string][]string{
+		"foo":  {`package foo; type T int`},
+		"main": {`package main; import "foo"; var _ foo.T`},
+	}).Setup(t)
+	defer os.RemoveAll(dir)
+
+	got := map[string]string{}
+	ctxt.WriteFile = func(filename string, content []byte) error {
+		got[filename] = string(content)
+		return nil
+	}
+	ctxt.MoveFile = func(from, to string) error {
+		return fmt.Errorf("git mv is failed")
+	}
+
+	if err := run(ctxt, &option{fromPkg: "foo", toPkg: "bar", inPkg: "main"}); err == nil {
+		t.Fatal("must be error")
+	}
+
+	want := map[string]string{
+		filepath.Join(dir, "src/foo/0.go"):  `package foo; type T int`,
+		filepath.Join(dir, "src/main/0.go"): `package main; import "foo"; var _ foo.T`,
+	}
+	for file, wantContent := range want {
+		if gotContent := got[file]; gotContent != wantContent {
+			t.Errorf("file %s is not restored; got <<<%s>>>\nwant <<<%s>>>", file, gotContent, wantContent)
+		}
+	}
+}
+
+func TestRollbackOnePackage(t *testing.T) {
+	ctxt, dir := fakeContext(map[string][]string{
+		"foo":     {`package foo; type T int`, `package foo; type S int`},
+		"foo/sub": {`package sub`},
+	}).Setup(t)
+	defer os.RemoveAll(dir)
+
+	// --only, the go files are moved one by one (the second move is failed)
+	ctxt.OnePackage = true
+	ctxt.MatchPkg = func(this, other string) bool { return this == other }
+	moved := 0
+	ctxt.MoveFile = func(from, to string) error {
+		if moved++; moved == 2 {
+			return fmt.Errorf("git mv is failed")
+		}
+		return os.Rename(from, to)
+	}
+
+	if err := run(ctxt, &option{fromPkg: "foo", toPkg: "bar", inPkg: "foo", only: true}); err == nil {
+		t.Fatal("must be error")
+	}
+
+	for _, name := range []string{"src/foo/0.go", "src/foo/1.go", "src/foo/sub/0.go"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("file %s is not restored (%s)", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "src/bar")); !os.IsNotExist(err) {
+		t.Errorf("created directory is not removed (%v)", err)
+	}
+}
+
+// recordingVCS : vcs recording the moves (the files are moved by renaming)
+type recordingVCS struct {
+	moves [][2]string
+}
+
+func (v *recordingVCS) Name() string { return "recording" }
+func (v *recordingVCS) Move(src, dst string) error {
+	v.moves = append(v.moves, [2]string{src, dst})
+	return os.Rename(src, dst)
+}
+func (v *recordingVCS) Status(paths ...string) ([]string, error)     { return nil, nil }
+func (v *recordingVCS) Commit(message string, paths ...string) error { return nil }
+
+func TestMoveVCS(t *testing.T) {
+	ctxt, dir := fakeContext(map[string][]string{"foo": {`package foo`}}).Setup(t)
+	defer os.RemoveAll(dir)
+
+	// the vcs of the copied context is used (also via the journal)
+	vcs := &recordingVCS{}
+	c := *ctxt
+	c.VCS = vcs
+	wctxt, _ := build.Transactional(&c)
+
+	src, dst := filepath.Join(dir, "src/foo"), filepath.Join(dir, "src/bar")
+	if err := wctxt.MovePackage(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if len(vcs.moves) != 1 || vcs.moves[0] != [2]string{src, dst} {
+		t.Errorf("moves do not match expectation; got %v", vcs.moves)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "0.go")); err != nil {
+		t.Errorf("the package is not moved (%s)", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		msg          string
+		ctxt         fakeGopath
+		from, to, in string
+		unsafe       bool
+		batch        int
+		wantErr      bool
+	}{
+		{
+			msg: "ok",
+			ctxt: fakeContext(map[string][]string{
+				"foo":  {`package foo; type T int`},
+				"main": {`package main; import "foo"; var _ foo.T`},
+			}),
+			from: "foo", to: "bar", in: "",
+		},
+		{
+			msg: "already existed errors are not reported",
+			ctxt: fakeContext(map[string][]string{
+				"foo":  {`package foo; type T int; var _ int = "x"`},
+				"main": {`package main; import "foo"; var _ foo.T`},
+			}),
+			from: "foo", to: "bar", in: "", unsafe: true,
+		},
+		{
+			msg: "already existed errors are not reported (streaming)",
+			ctxt: fakeContext(map[string][]string{
+				"foo":  {`package foo; type T int; var _ int = "x"`},
+				"main": {`package main; import "foo"; var _ foo.T; var _ int = "y"`},
+				"sub":  {`package sub; import "foo"; var _ foo.T`},
+			}),
+			from: "foo", to: "bar", in: "", unsafe: true, batch: 1,
+		},
+		{
+			msg: "already existed errors mentioning the moved package are not reported",
+			ctxt: fakeContext(map[string][]string{
+				"foo":  {`package foo; type T int`},
+				"main": {`package main; import "foo"; var _ foo.T; var _ = foo.Missing`},
+			}),
+			from: "foo", to: "bar", in: "", unsafe: true,
+		},
+		{
+			msg: "introduced errors are reported",
+			ctxt: fakeContext(map[string][]string{
+				"a/internal/i": {`package i; type T int`},
+				"a/b":          {`package b; import "a/internal/i"; var _ i.T`},
+				"main":         {`package main; import "a/b"; var _ b.T`},
+			}),
+			from: "a/b", to: "c/b", in: "", wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.msg, func(t *testing.T) {
+			t.Parallel()
+			ctxt, dir := test.ctxt.Setup(t)
+			defer os.RemoveAll(dir)
+			ctxt.VCS = build.FileSystem // not git repository
+
+			err := run(ctxt, &option{fromPkg: test.from, toPkg: test.to, inPkg: test.in, unsafe: test.unsafe, batch: test.batch, verify: true})
+			if test.wantErr && err == nil {
+				t.Error("must be error")
+			}
+			if !test.wantErr && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		})
+	}
+}
+
+func TestDirtyWorkingTree(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not found")
+	}
+
+	for _, force := range []bool{false, true} {
+		ctxt, dir := fakeContext(map[string][]string{
+			"foo":  {`package foo; type T int`},
+			"main": {`package main; import "foo"; var _ foo.T`},
+		}).Setup(t)
+		defer os.RemoveAll(dir)
+		ctxt.VCS = build.Git
+
+		gitInit(t, dir)
+
+		// hand edit
+		if err := ioutil.WriteFile(filepath.Join(dir, "src/foo/1.go"), []byte(`package foo; type S int`), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		err := run(ctxt, &option{fromPkg: "foo", toPkg: "bar", inPkg: "", force: force})
+		if !force && err == nil {
+			t.Error("must be error, if the working tree is dirty")
+		}
+		if force && err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+}
+
+func TestCommit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not found")
+	}
+
+	ctxt, dir := fakeContext(map[string][]string{
+		"foo":  {`package foo; type T int`},
+		"main": {`package main; import "foo"; var _ foo.T`},
+	}).Setup(t)
+	defer os.RemoveAll(dir)
+	ctxt.VCS = build.Git
+	gitInit(t, dir)
+
+	if err := run(ctxt, &option{fromPkg: "foo", toPkg: "bar", inPkg: "", commit: true}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := `move package foo -> bar
+
+rewritten files:
+- foo: 1
+- main: 1
+`
+	if got := git(t, dir, "log", "-1", "--format=%B"); strings.TrimSpace(got) != strings.TrimSpace(want) {
+		t.Errorf("commit message does not match expectation; got <<<%s>>>\nwant <<<%s>>>", got, want)
+	}
+	if got := git(t, dir, "status", "--porcelain"); got != "" {
+		t.Errorf("working tree must be clean after commit, but %s", got)
+	}
+}
+
+func TestCommitWithoutVCS(t *testing.T) {
+	ctxt, dir := fakeContext(map[string][]string{
+		"foo":  {`package foo; type T int`},
+		"main": {`package main; import "foo"; var _ foo.T`},
+	}).Setup(t)
+	defer os.RemoveAll(dir)
+	ctxt.VCS = build.FileSystem
+
+	// rejected before anything is written (even with --force)
+	if err := run(ctxt, &option{fromPkg: "foo", toPkg: "bar", inPkg: "", commit: true, force: true}); err == nil {
+		t.Fatal("must be error")
+	}
+	got := readFiles(filepath.Join(dir, "src"))
+	want := map[string]string{
+		"foo/0.go":  `package foo; type T int`,
+		"main/0.go": `package main; import "foo"; var _ foo.T`,
+	}
+	if len(got) != len(want) || got["foo/0.go"] != want["foo/0.go"] || got["main/0.go"] != want["main/0.go"] {
+		t.Errorf("files are changed; got %v", got)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	ctxt, dir := fakeContext(map[string][]string{
+		"a": {`package a; type A int`},
+		"b": {`package b; type B int`},
+		"x": {`package x; type X int`},
+		"main": {`package main
+
+import (
+	"a"
+	"b"
+	"x"
+)
+
+var _ a.A
+var _ b.B
+var _ x.X
+`},
+	}).Setup(t)
+	defer os.RemoveAll(dir)
+	ctxt.VCS = build.FileSystem // not git repository
+
+	// a -> b is applied after b -> c
+	manifest := filepath.Join(dir, "moves.yaml")
+	if err := ioutil.WriteFile(manifest, []byte(`moves:
+  - {from: a, to: b}
+  - {from: b, to: c}
+  - {from: x, to: y}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runManifest(ctxt, &option{manifest: manifest, verify: true}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := map[string]string{
+		"src/b/0.go": "package b\n\ntype A int\n",
+		"src/c/0.go": "package c\n\ntype B int\n",
+		"src/y/0.go": "package y\n\ntype X int\n",
+		"src/main/0.go": `package main
+
+import (
+	"b"
+	"c"
+	"y"
+)
+
+var _ b.A
+var _ c.B
+var _ y.X
+`,
+	}
+	for file, wantContent := range want {
+		b, err := ioutil.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+			continue
+		}
+		if got := string(b); got != wantContent {
+			t.Errorf("file %s does not match expectation; got <<<%s>>>\nwant <<<%s>>>", file, got, wantContent)
+		}
+	}
+	for _, file := range []string{"src/a", "src/x"} {
+		if _, err := os.Stat(filepath.Join(dir, file)); err == nil {
+			t.Errorf("%s must be moved", file)
+		}
+	}
+}
+
+func TestManifestSort(t *testing.T) {
+	tests := []struct {
+		msg     string
+		moves   []Move
+		want    string
+		wantErr string
+	}{
+		{
+			msg:   "independent",
+			moves: []Move{{From: "a", To: "x"}, {From: "b", To: "y"}},
+			want:  "[{a x} {b y}]",
+		},
+		{
+			msg:   "chained",
+			moves: []Move{{From: "a", To: "b"}, {From: "b", To: "c"}, {From: "c", To: "d"}},
+			want:  "[{c d} {b c} {a b}]",
+		},
+		{
+			msg:   "into sub package of moved package",
+			moves: []Move{{From: "x", To: "b/x"}, {From: "b", To: "c"}},
+			want:  "[{b c} {x b/x}]",
+		},
+		{
+			msg:     "overlapped sources",
+			moves:   []Move{{From: "a", To: "x"}, {From: "a/b", To: "y"}},
+			wantErr: "overlapped sources: a and a/b",
+		},
+		{
+			msg:   "into sub package of another destination",
+			moves: []Move{{From: "b", To: "x/b"}, {From: "a", To: "x"}},
+			want:  "[{a x} {b x/b}]",
+		},
+		{
+			msg:     "overlapped destinations",
+			moves:   []Move{{From: "a", To: "x"}, {From: "b", To: "x"}},
+			wantErr: "overlapped destinations: x and x",
+		},
+		{
+			msg:     "cyclic",
+			moves:   []Move{{From: "a", To: "b"}, {From: "b", To: "a"}},
+			wantErr: "cyclic moves: a -> b, b -> a",
+		},
+	}
+	for _, test := range tests {
+		m := &Manifest{Moves: test.moves}
+		got, err := m.Sort(build.Recursively())
+		if test.wantErr != "" {
+			if err == nil || err.Error() != test.wantErr {
+				t.Errorf("%s: error does not match expectation; got %v, want %s", test.msg, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.msg, err)
+			continue
+		}
+		if fmt.Sprint(got) != test.want {
+			t.Errorf("%s: order does not match expectation; got %v, want %s", test.msg, got, test.want)
+		}
+	}
+}
+
+func TestPattern(t *testing.T) {
+	ctxt, dir := fakeContext(map[string][]string{
+		"app/legacy/a":     {`package a; type A int`},
+		"app/legacy/a/sub": {`package sub; type S int`},
+		"app/legacy/b":     {`package b; type B int`},
+		"app/x/model":      {`package model; type X int`},
+		"app/y/model":      {`package model; type Y int`},
+		"app/main": {`package main
+
+import (
+	"app/legacy/a/sub"
+	"app/legacy/b"
+)
+
+var _ sub.S
+var _ b.B
+`},
+	}).Setup(t)
+	defer os.RemoveAll(dir)
+	ctxt.VCS = build.FileSystem // not git repository
+
+	root, err := collect.TargetRoot(ctxt, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgdirs, err := collect.GoFilesDirectories(context.Background(), ctxt, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		from, to string
+		regexp   bool
+		want     string
+		wantErr  string
+	}{
+		{
+			from: "app/legacy/...", to: "app/v2/...",
+			want: "[{app/legacy/a app/v2/a} {app/legacy/b app/v2/b}]", // sub package is moved with the parent
+		},
+		{
+			from: "app/.../model", to: "app/model/...",
+			want: "[{app/x/model app/model/x} {app/y/model app/model/y}]",
+		},
+		{
+			from: `app/(\w+)/model`, to: "app/model/$1", regexp: true,
+			want: "[{app/x/model app/model/x} {app/y/model app/model/y}]",
+		},
+		{
+			from: `app/legacy/(a|b)`, to: "app/v3/${1}x", regexp: true,
+			want: "[{app/legacy/a app/v3/ax} {app/legacy/b app/v3/bx}]",
+		},
+		{
+			from: "app/legacy/...", to: "app/v2",
+			wantErr: "the number of wildcards is mismatched (from app/legacy/..., to app/v2)",
+		},
+		{
+			from: "app/nothing/...", to: "app/v2/...",
+			wantErr: `no packages are matched with ^app/nothing(/.*)?$`,
+		},
+	}
+	for _, test := range tests {
+		compile := CompilePattern
+		if test.regexp {
+			compile = CompileRegexp
+		}
+		m, err := func() (*Manifest, error) {
+			p, err := compile(test.from, test.to)
+			if err != nil {
+				return nil, err
+			}
+			return p.Expand(ctxt, root, pkgdirs)
+		}()
+		if test.wantErr != "" {
+			if err == nil || err.Error() != test.wantErr {
+				t.Errorf("%s: error does not match expectation; got %v, want %s", test.from, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.from, err)
+			continue
+		}
+		if got := fmt.Sprint(m.Moves); got != test.want {
+			t.Errorf("%s: moves do not match expectation; got %s, want %s", test.from, got, test.want)
+		}
+	}
+
+	if err := runPattern(ctxt, &option{fromPkg: "app/legacy/...", toPkg: "app/v2/...", inPkg: "app"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := `package main
+
+import (
+	"app/v2/a/sub"
+	"app/v2/b"
+)
+
+var _ sub.S
+var _ b.B
+`
+	b, err := ioutil.ReadFile(filepath.Join(dir, "src/app/main/0.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(b); got != want {
+		t.Errorf("file does not match expectation; got <<<%s>>>\nwant <<<%s>>>", got, want)
+	}
+	for _, path := range []string{"src/app/v2/a/sub/0.go", "src/app/v2/b/0.go"} {
+		if _, err := os.Stat(filepath.Join(dir, path)); err != nil {
+			t.Errorf("%s must be existed, %s", path, err)
+		}
+	}
+}
+
+func git(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	b, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %s, %s", args, err, b)
+	}
+	return string(b)
+}
+
+func gitInit(t *testing.T, dir string) {
+	git(t, dir, "init", "-q")
+	git(t, dir, "config", "user.name", "test")
+	git(t, dir, "config", "user.email", "test@example.com")
+	git(t, dir, "add", "-A")
+	git(t, dir, "commit", "-q", "-m", "init")
 }
@@ -0,0 +1,83 @@
+package load
+
+import (
+	"fmt"
+	"go/token"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/podhmo/gomvpkg-light/build"
+	"github.com/podhmo/gomvpkg-light/collect"
+	"golang.org/x/tools/go/packages"
+)
+
+// Mode : syntax and type information are needed only for the initial packages (dependencies are loaded from export data)
+const Mode = packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles | packages.NeedImports |
+	packages.NeedTypes | packages.NeedTypesSizes | packages.NeedSyntax | packages.NeedTypesInfo
+
+// Config :
+type Config struct {
+	AllowErrors bool
+	Verbose     bool
+	Fset        *token.FileSet // if nil, new FileSet is used
+}
+
+// Load loads packages (with tests)
+func (c *Config) Load(ctxt *build.Context, root *collect.Target, pkgs []string) (*Program, error) {
+	fset := c.Fset
+	if fset == nil {
+		fset = token.NewFileSet()
+	}
+	pc := &packages.Config{
+		Mode:       Mode,
+		Fset:       fset,
+		Tests:      true,
+		Dir:        ctxt.Ctxt.Dir,
+		Env:        Env(ctxt, root),
+		BuildFlags: BuildFlags(ctxt),
+	}
+	if root.Module != nil {
+		pc.Dir = root.Module.Dir
+	}
+
+	initial, err := packages.Load(pc, pkgs...)
+	if err != nil {
+		return nil, errors.Wrap(err, "load packages")
+	}
+
+	prog := NewProgram(fset, initial)
+	if errs := prog.Errors(); len(errs) > 0 {
+		if !c.AllowErrors {
+			msgs := make([]string, len(errs))
+			for i, e := range errs {
+				msgs[i] = e.Error()
+			}
+			return nil, errors.Errorf("couldn't load packages due to errors: %s", strings.Join(msgs, ", "))
+		}
+		if c.Verbose {
+			for _, e := range errs {
+				log.Println(e)
+			}
+		}
+	}
+	return prog, nil
+}
+
+// Env : environment variables for go command (GOPATH mode, if root is not a part of module)
+func Env(ctxt *build.Context, root *collect.Target) []string {
+	env := append(os.Environ(), fmt.Sprintf("GOPATH=%s", ctxt.Ctxt.GOPATH))
+	if root.Module == nil {
+		env = append(env, "GO111MODULE=off")
+	}
+	return env
+}
+
+// BuildFlags : build flags for go command
+func BuildFlags(ctxt *build.Context) []string {
+	if len(ctxt.Ctxt.BuildTags) == 0 {
+		return nil
+	}
+	return []string{"-tags=" + strings.Join(ctxt.Ctxt.BuildTags, ",")}
+}
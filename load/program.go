@@ -0,0 +1,77 @@
+package load
+
+import (
+	"go/token"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// Program :
+type Program struct {
+	Fset        *token.FileSet
+	Initial     []*packages.Package
+	AllPackages []*packages.Package
+
+	byPath map[string]*packages.Package
+}
+
+// NewProgram :
+func NewProgram(fset *token.FileSet, initial []*packages.Package) *Program {
+	prog := &Program{
+		Fset:    fset,
+		Initial: initial,
+		byPath:  map[string]*packages.Package{},
+	}
+	packages.Visit(initial, nil, func(pkg *packages.Package) {
+		prog.AllPackages = append(prog.AllPackages, pkg)
+	})
+
+	for _, pkg := range initial {
+		if pkg.Types == nil || pkg.TypesInfo == nil {
+			continue
+		}
+		// "foo [foo.test]" (including in-package test files) is preferred than "foo"
+		if prev, ok := prog.byPath[pkg.PkgPath]; ok && !isTestVariant(pkg) && isTestVariant(prev) {
+			continue
+		}
+		prog.byPath[pkg.PkgPath] = pkg
+	}
+	return prog
+}
+
+// Package returns the type-checked package (with syntax), by import path
+func (prog *Program) Package(path string) *packages.Package {
+	return prog.byPath[path]
+}
+
+func isTestVariant(pkg *packages.Package) bool {
+	return strings.Contains(pkg.ID, " [")
+}
+
+// Error : error with the path of package
+type Error struct {
+	PkgPath string
+	Err     packages.Error
+}
+
+func (e Error) Error() string {
+	return e.Err.Error()
+}
+
+// Errors returns the errors of all loaded packages (deduplicated, test variants have same errors)
+func (prog *Program) Errors() []Error {
+	var errs []Error
+	seen := map[string]bool{}
+	for _, pkg := range prog.AllPackages {
+		for _, e := range pkg.Errors {
+			k := e.Error()
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			errs = append(errs, Error{PkgPath: pkg.PkgPath, Err: e})
+		}
+	}
+	return errs
+}
@@ -0,0 +1,103 @@
+package load
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/podhmo/gomvpkg-light/build"
+	"github.com/podhmo/gomvpkg-light/collect"
+)
+
+// Verify reloads the packages after moving, and returns the errors introduced by the move.
+// rename converts an import path before moving to the one after moving.
+// existed is the errors before moving (if nil, all errors after moving are returned).
+func (c *Config) Verify(ctxt *build.Context, root *collect.Target, existed []Error, pkgs []string, rename func(string) string) ([]Error, error) {
+	renamed := make([]string, len(pkgs))
+	for i, pkg := range pkgs {
+		renamed[i] = rename(pkg)
+	}
+
+	vc := *c
+	vc.AllowErrors = true
+	vc.Verbose = false
+	vc.Fset = nil
+	after, err := vc.Load(ctxt, root, renamed)
+	if err != nil {
+		return nil, err
+	}
+
+	// the package names in the messages are changed by the move (e.g. "undefined: foo.X" -> "undefined: bar.X")
+	names := map[string]string{}
+	for i, pkg := range pkgs {
+		if renamed[i] == pkg {
+			continue
+		}
+		name := path.Base(renamed[i])
+		if p := after.Package(renamed[i]); p != nil {
+			name = p.Types.Name()
+		}
+		if _, ok := names[path.Base(pkg)]; !ok {
+			names[path.Base(pkg)] = name
+		}
+	}
+
+	// positions are not compared (the files are rewritten)
+	counts := map[string]int{}
+	for _, e := range existed {
+		msg := normalize(e.Err.Msg)
+		if msg == "" {
+			continue
+		}
+		counts[rename(e.PkgPath)+"\x00"+translate(msg, rename, names)]++
+	}
+
+	var introduced []Error
+	for _, e := range after.Errors() {
+		msg := normalize(e.Err.Msg)
+		if msg == "" {
+			continue // package header only
+		}
+		k := e.PkgPath + "\x00" + msg
+		if counts[k] > 0 {
+			counts[k]--
+			continue
+		}
+		introduced = append(introduced, e)
+	}
+	return introduced, nil
+}
+
+var positionRX = regexp.MustCompile(`[^\s:]+\.go:\d+(:\d+)?: `)
+
+// normalize removes positions and package headers ("# <pkg>") from the message of go list
+func normalize(msg string) string {
+	var lines []string
+	for _, line := range strings.Split(msg, "\n") {
+		if strings.HasPrefix(line, "# ") {
+			continue
+		}
+		lines = append(lines, positionRX.ReplaceAllString(line, ""))
+	}
+	return strings.Join(lines, "\n")
+}
+
+var (
+	quotedRX    = regexp.MustCompile(`"[^"\s]+"`)
+	qualifiedRX = regexp.MustCompile(`(^|[^\p{L}\p{N}_.])([\p{L}_][\p{L}\p{N}_]*)\.`)
+)
+
+// translate converts the import paths and the package names in the message before moving, to the ones after moving
+func translate(msg string, rename func(string) string, names map[string]string) string {
+	msg = quotedRX.ReplaceAllStringFunc(msg, func(s string) string {
+		return strconv.Quote(rename(s[1 : len(s)-1]))
+	})
+	return qualifiedRX.ReplaceAllStringFunc(msg, func(s string) string {
+		m := qualifiedRX.FindStringSubmatch(s)
+		if name, ok := names[m[2]]; ok {
+			return m[1] + name + "."
+		}
+		return s
+	})
+}
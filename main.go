@@ -2,23 +2,26 @@ package main
 
 import (
 	"bytes"
-	"go/parser"
+	"fmt"
 	"go/printer"
 	"go/token"
-	"go/types"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
 	"runtime/debug"
 	"runtime/pprof"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/podhmo/gomvpkg-light/build"
 	"github.com/podhmo/gomvpkg-light/collect"
+	"github.com/podhmo/gomvpkg-light/load"
 	"github.com/podhmo/gomvpkg-light/move"
-	"golang.org/x/tools/go/loader"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 )
 
@@ -27,12 +30,28 @@ type option struct {
 	toPkg   string
 	inPkg   string
 
-	only bool
+	manifest string
+	regexp   bool
+	files    string
+	decls    string
+	name     string
+
+	only   bool
+	dryRun bool
+	verify bool
+	vcs    string
+	force  bool
+	commit bool
+	jobs   int
+	batch  int
+
+	cacheDir string
 
 	fProfile string
 
 	disableGC bool
 	unsafe    bool
+	syntactic bool
 	verbose   bool
 }
 
@@ -40,19 +59,55 @@ func main() {
 	var option option
 	cmd := kingpin.New("gomvpkg-light", "gomvpkg-light")
 
-	cmd.Flag("from", "Import path of package to be moved").Required().StringVar(&option.fromPkg)
+	cmd.Flag("from", "Import path of package to be moved").StringVar(&option.fromPkg)
 	cmd.Flag("to", "Destination import path for package").StringVar(&option.toPkg)
 	cmd.Flag("in", "target area").StringVar(&option.inPkg)
+	cmd.Flag("regexp", "from is regular expression, and to is replacement (e.g. $1)").BoolVar(&option.regexp)
+	cmd.Flag("manifest", "moves file (json or yaml), applying many moves at once").StringVar(&option.manifest)
+	cmd.Flag("files", "comma separated file names (or glob patterns), only these files are moved into the new package").StringVar(&option.files)
+	cmd.Flag("decls", "comma separated names of top-level declarations, only these (and the unexported helpers used only by them) are moved").StringVar(&option.decls)
+	cmd.Flag("name", "the package name after moving (without --to, only the package clause is renamed)").StringVar(&option.name)
 	cmd.Flag("only", "from package only moved(sub packages are not moved)").BoolVar(&option.only)
-
+	cmd.Flag("dry-run", "nothing is written, printing unified diff instead").BoolVar(&option.dryRun)
+	cmd.Flag("verify", "type check after moving (reporting the errors introduced by the move)").BoolVar(&option.verify)
+	cmd.Flag("force", "run even if the working tree has uncommitted changes").BoolVar(&option.force)
+	cmd.Flag("commit", "commit the move (with the message describing it)").BoolVar(&option.commit)
+	cmd.Flag("vcs", "vcs used for moving files (auto, git, hg, none)").Default("auto").EnumVar(&option.vcs, "auto", "git", "hg", "none")
+
+	cmd.Flag("jobs", "the number of concurrent workers (default: the number of CPUs)").Short('j').IntVar(&option.jobs)
+	cmd.Flag("cache-dir", "directory of the import index (default: empty, the index is not used)").StringVar(&option.cacheDir)
+	cmd.Flag("batch", "the number of packages loaded at once (streaming, for bounding memory. default: all packages)").IntVar(&option.batch)
 	cmd.Flag("profile", "profile").StringVar(&option.fProfile)
 	cmd.Flag("disable-gc", "disable gc (for speed)").BoolVar(&option.disableGC)
-	cmd.Flag("unsafe", "unsafe option (for speed)").BoolVar(&option.unsafe)
+	cmd.Flag("unsafe", "unsafe option (for speed, type errors are ignored)").BoolVar(&option.unsafe)
+	cmd.Flag("syntactic", "without type checking (type checked only if the rewriting is ambiguous)").BoolVar(&option.syntactic)
 	cmd.Flag("verbose", "verbose").Short('v').BoolVar(&option.verbose)
 
 	if _, err := cmd.Parse(os.Args[1:]); err != nil {
 		cmd.FatalUsage(err.Error())
 	}
+	if option.fromPkg == "" && option.manifest == "" {
+		cmd.FatalUsage("required flag --from (or --manifest) not provided")
+	}
+
+	if option.name != "" {
+		if !token.IsIdentifier(option.name) || option.name == "_" {
+			cmd.FatalUsage(fmt.Sprintf("invalid package name %q", option.name))
+		}
+		if option.manifest != "" || option.regexp || IsPattern(option.fromPkg) {
+			cmd.FatalUsage("--name cannot be used with many moves")
+		}
+		if option.toPkg == "" {
+			option.toPkg = option.fromPkg // renaming only
+		}
+	}
+
+	if (option.files != "" || option.decls != "") && (option.only || option.manifest != "" || option.name != "") {
+		cmd.FatalUsage("--files and --decls cannot be used with --only, --manifest (or --name)")
+	}
+	if option.files != "" && option.decls != "" {
+		cmd.FatalUsage("--files and --decls cannot be used together")
+	}
 
 	if option.disableGC || option.unsafe {
 		log.Println("gc is disabled")
@@ -73,86 +128,322 @@ func main() {
 	if option.only {
 		ctxt = build.OnePackageOnly()
 	}
+	vcs, err := build.LookupVCS(option.vcs)
+	if err != nil {
+		cmd.FatalUsage(err.Error())
+	}
+	ctxt.VCS = vcs
+	if option.jobs > 0 {
+		ctxt.Jobs = option.jobs
+	}
+	if option.dryRun {
+		ctxt = build.DryRun(ctxt, os.Stdout)
+	}
 
+	if option.manifest != "" {
+		if err := runManifest(ctxt, &option); err != nil {
+			log.Fatalf("gomvpkg-light: %+v.\n", err)
+		}
+		return
+	}
+	if option.files != "" || option.decls != "" {
+		if err := runSplit(ctxt, &option); err != nil {
+			log.Fatalf("gomvpkg-light: %+v.\n", err)
+		}
+		return
+	}
+	if option.regexp || IsPattern(option.fromPkg) {
+		if err := runPattern(ctxt, &option); err != nil {
+			log.Fatalf("gomvpkg-light: %+v.\n", err)
+		}
+		return
+	}
 	if err := run(ctxt, &option); err != nil {
 		log.Fatalf("gomvpkg-light: %+v.\n", err)
 	}
 }
 
 func run(ctxt *build.Context, option *option) error {
-	log.Printf("start move package %s -> %s", option.fromPkg, option.toPkg)
-	st := time.Now()
-	defer func() {
-		log.Printf("takes %v", time.Now().Sub(st))
-		log.Println("end")
-	}()
-
-	root, err := collect.TargetRoot(ctxt, option.inPkg)
+	inPlace := option.fromPkg == option.toPkg
+	if inPlace {
+		log.Printf("start rename package %s (package %s)", option.fromPkg, option.name)
+	} else {
+		log.Printf("start move package %s -> %s", option.fromPkg, option.toPkg)
+	}
+	defer logElapsed(time.Now())
+
+	if inPlace {
+		if option.name == "" {
+			return errors.Errorf("%s is moved to itself (--name, for renaming the package)", option.fromPkg)
+		}
+		// only the package clause is renamed, the sub packages are not affected
+		c := *ctxt
+		c.MatchPkg = func(this, other string) bool {
+			return this == other
+		}
+		ctxt = &c
+	}
+
+	s, err := newSession(ctxt, option)
 	if err != nil {
 		return err
 	}
-	log.Printf("get in-pkg %s", root.Path)
 
-	pkgdirs, err := collect.GoFilesDirectories(ctxt, root)
+	srctarget, err := collect.TargetRoot(ctxt, option.fromPkg)
+	if err != nil {
+		return errors.Errorf("invalid source %s", option.fromPkg)
+	}
+	dsttarget, err := collect.TargetRoot(ctxt, option.toPkg)
+	if err != nil {
+		if dsttarget, err = collect.NewTarget(ctxt, srctarget, option.toPkg); err != nil {
+			return errors.Wrap(err, "invalid destination")
+		}
+	}
+
+	if err := s.preflight(srctarget.Path, dsttarget.Path); err != nil {
+		return err
+	}
+	if err := s.collect(); err != nil {
+		return err
+	}
+	affected, err := s.affected(option.fromPkg)
 	if err != nil {
 		return err
 	}
-	log.Printf("collect candidate directories %d", len(pkgdirs))
 
-	affected, err := collect.AffectedPackages(ctxt, option.fromPkg, root, pkgdirs)
+	existing := !dsttarget.NeedCreate && !inPlace
+	merge := existing && hasGoFiles(ctxt, dsttarget.Path)
+	pkgs := []string{option.fromPkg}
+	if merge {
+		log.Printf("%s is existed, merged into it", option.toPkg)
+		pkgs = append(pkgs, option.toPkg)
+	} else if existing {
+		log.Printf("%s is existed (without go files), moved into it", option.toPkg)
+	}
+	for _, a := range affected[0] {
+		pkgs = append(pkgs, strings.TrimSuffix(a.Pkg, "_test"))
+	}
+
+	req := &move.Req{
+		FromPkg:     option.fromPkg,
+		ToPkg:       option.toPkg,
+		InPkg:       option.inPkg,
+		Root:        s.root,
+		Affected:    affected[0],
+		WillBeWrite: map[*token.File]*move.PreWrite{},
+		ToName:      option.name,
+		Merge:       merge,
+		Verbose:     option.verbose,
+	}
+	if existing {
+		if conflicts := mergeConflicts(ctxt, srctarget, dsttarget, option); len(conflicts) > 0 {
+			return conflictError(conflicts)
+		}
+	}
+	if req.Merge {
+		if option.syntactic {
+			log.Println("syntactic option is ignored with merging")
+			option.syntactic = false
+		}
+		if option.name != "" {
+			log.Printf("name option is ignored with merging (the name of %s is used)", option.toPkg)
+			req.ToName = ""
+		}
+	}
 
+	var existed []load.Error
+	err = s.transact(func(wctxt *build.Context) error {
+		var err error
+		existed, err = rewrite(ctxt, wctxt, s.config, req, pkgs, srctarget, dsttarget, option)
+		if err != nil {
+			return err
+		}
+		logStat(req)
+		switch {
+		case inPlace:
+			return nil // the directory is not moved
+		case existing:
+			return mergePackage(wctxt, srctarget, dsttarget, option)
+		default:
+			return movePackage(wctxt, srctarget, dsttarget)
+		}
+	})
 	if err != nil {
 		return err
 	}
-	log.Printf("collect affected packages %d", len(affected))
 
-	// slow
-	c := loader.Config{
-		Build: ctxt.Ctxt,
-		TypeCheckFuncBodies: func(path string) bool {
-			if !strings.HasPrefix(path, root.Pkg) {
-				return false
-			}
-			if strings.Contains(path, "/vendor/") {
-				return false
-			}
-			return true
+	header := fmt.Sprintf("move package %s -> %s\n", req.FromPkg, req.ToPkg)
+	if inPlace {
+		header = fmt.Sprintf("rename package %s (package %s)\n", req.FromPkg, req.ToName)
+	}
+	return s.finish(&result{
+		existed: existed,
+		pkgs:    pkgs,
+		rename: func(path string) string {
+			return ctxt.RenamePkg(option.fromPkg, option.toPkg, path)
 		},
-		ParserMode: parser.ParseComments,
+		req:    req,
+		header: header,
+		srcs:   []*collect.Target{srctarget},
+		dsts:   []*collect.Target{dsttarget},
+	})
+}
+
+// rewrite rewrites and writes the files, and returns the errors existed before moving
+func rewrite(ctxt, wctxt *build.Context, c *load.Config, req *move.Req, pkgs []string, srctarget, dsttarget *collect.Target, option *option) ([]load.Error, error) {
+	if option.syntactic {
+		fset := token.NewFileSet()
+		sc := *c
+		sc.Fset = fset
+		s := &move.Syntactic{
+			Ctxt: ctxt,
+			Fset: fset,
+			Src:  srctarget,
+			Dst:  dsttarget,
+			TypeCheck: func(ambiguous []string) (*load.Program, error) {
+				log.Printf("loading %d packages including ambiguous files..", len(ambiguous))
+				return sc.Load(ctxt, req.Root, append([]string{option.fromPkg}, ambiguous...))
+			},
+		}
+		if err := s.TargetPackage(req); err != nil {
+			return nil, err
+		}
+		if err := s.AffectedPackages(req); err != nil {
+			return nil, err
+		}
+		return nil, write(wctxt, fset, req, option)
+	}
+
+	if option.batch <= 0 {
+		return rewriteBatch(ctxt, wctxt, c, req, pkgs, true, option)
+	}
+
+	// streaming, the packages are loaded, rewritten and printed in batches (the source package is loaded in each batch)
+	var others []string
+	seen := map[string]bool{option.fromPkg: true}
+	if req.Merge {
+		seen[option.toPkg] = true
+	}
+	for _, pkg := range pkgs {
+		if !seen[pkg] {
+			seen[pkg] = true
+			others = append(others, pkg)
+		}
+	}
+
+	all := req.Affected
+	defer func() { req.Affected = all }()
+
+	// the printed files are written after all batches (the later batches are loaded from the original files).
+	// until then, they are spooled in the temporary directory (not kept in memory)
+	spool, err := ioutil.TempDir("", "gomvpkg-light")
+	if err != nil {
+		return nil, errors.Wrap(err, "create spool directory")
+	}
+	defer os.RemoveAll(spool)
+
+	type pendingWrite struct {
+		path    string
+		spooled string
+	}
+	var pending []pendingWrite
+	bctxt := *wctxt
+	bctxt.WriteFile = func(path string, b []byte) error {
+		spooled := filepath.Join(spool, strconv.Itoa(len(pending)))
+		if err := ioutil.WriteFile(spooled, b, 0644); err != nil {
+			return errors.Wrapf(err, "spool %s", path)
+		}
+		pending = append(pending, pendingWrite{path: path, spooled: spooled})
+		return nil
 	}
 
-	if option.unsafe {
-		log.Println("unsafe option is enabled, aggressive optimization")
-		unsafeOptimization(&c, option, affected)
+	var existed []load.Error
+	seenErrs := map[string]bool{}
+	for i := 0; i == 0 || i < len(others); i += option.batch {
+		end := i + option.batch
+		if end > len(others) {
+			end = len(others)
+		}
+		batch := others[i:end]
+		inBatch := map[string]bool{}
+		for _, pkg := range batch {
+			inBatch[pkg] = true
+		}
+		req.Affected = nil
+		for _, a := range all {
+			pkg := strings.TrimSuffix(a.Pkg, "_test")
+			if inBatch[pkg] || (i == 0 && (pkg == option.fromPkg || pkg == option.toPkg)) {
+				req.Affected = append(req.Affected, a)
+			}
+		}
+
+		log.Printf("batch %d-%d/%d", i+1, i+len(batch), len(others))
+		loaded := []string{option.fromPkg}
+		if req.Merge {
+			loaded = append(loaded, option.toPkg)
+		}
+		errs, err := rewriteBatch(ctxt, &bctxt, c, req, append(loaded, batch...), i == 0, option)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range errs {
+			if k := e.Error(); !seenErrs[k] {
+				seenErrs[k] = true
+				existed = append(existed, e)
+			}
+		}
+
+		if option.disableGC || option.unsafe {
+			runtime.GC() // gc is disabled, released explicitly
+		}
 	}
 
-	c.ImportWithTests(option.fromPkg)
-	for _, a := range affected {
-		if a.IsXTest {
-			c.ImportWithTests(strings.TrimSuffix(a.Pkg, "_test"))
-			continue
+	for _, w := range pending {
+		b, err := ioutil.ReadFile(w.spooled)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read spooled %s", w.path)
+		}
+		if err := wctxt.WriteFile(w.path, b); err != nil {
+			return nil, err
 		}
-		c.ImportWithTests(a.Pkg)
 	}
+	return existed, nil
+}
+
+// rewriteBatch loads pkgs and rewrites req.Affected (if target is true, the source package is also rewritten)
+func rewriteBatch(ctxt, wctxt *build.Context, c *load.Config, req *move.Req, pkgs []string, target bool, option *option) ([]load.Error, error) {
+	bc := *c
+	bc.Fset = token.NewFileSet()
 
+	// slow
 	log.Println("loading packages..")
-	prog, err := c.Load()
+	prog, err := bc.Load(ctxt, req.Root, pkgs)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	log.Printf("%d packages are loaded", len(prog.AllPackages))
 
-	req := &move.Req{
-		FromPkg:     option.fromPkg,
-		ToPkg:       option.toPkg,
-		InPkg:       option.inPkg,
-		Root:        root,
-		Affected:    affected,
-		WillBeWrite: map[*token.File]*move.PreWrite{},
-		Verbose:     option.verbose,
+	if target {
+		if err := targetPackage(prog, req); err != nil {
+			return nil, err
+		}
 	}
 
-	// todo: check
+	if err := move.AffectedPackages(ctxt, prog, req); err != nil {
+		return nil, err
+	}
+	return prog.Errors(), write(wctxt, prog.Fset, req, option)
+}
+
+// targetPackage rewrites the source package (including xxx_test package)
+func targetPackage(prog *load.Program, req *move.Req) error {
+	if req.Merge {
+		// checked before rewriting, nothing is written if the merge is impossible
+		conflicts := append(move.DuplicateDecls(prog, req), move.ShadowedUses(prog, req)...)
+		if len(conflicts) > 0 {
+			return conflictError(conflicts)
+		}
+	}
 	if err := move.TargetPackage(prog, req); err != nil {
 		return err
 	}
@@ -161,35 +452,106 @@ func run(ctxt *build.Context, option *option) error {
 		xreq := *req
 		xreq.FromPkg = req.FromPkg + "_test"
 		xreq.ToPkg = req.ToPkg + "_test"
+		if xreq.ToName != "" {
+			xreq.ToName += "_test"
+		}
 		if err := move.TargetPackage(prog, &xreq); err != nil {
 			return err
 		}
 	}
+	return nil
+}
 
-	if err := move.AffectedPackages(ctxt, prog, req); err != nil {
-		return err
+// commit commits the rewritten files and the moved packages
+func commit(ctxt *build.Context, req *move.Req, message string, srcs, dsts []*collect.Target) error {
+	var paths []string
+	for _, name := range req.Written() {
+		moved := false
+		for _, src := range srcs {
+			if strings.HasPrefix(name, src.Path+string(filepath.Separator)) {
+				moved = true
+			}
+		}
+		if !moved {
+			paths = append(paths, name)
+		}
+	}
+	for i := range srcs {
+		paths = append(paths, srcs[i].Path, dsts[i].Path)
 	}
 
-	srctarget, err := collect.TargetRoot(ctxt, option.fromPkg)
+	log.Printf("commit (%s)", ctxt.VCS.Name())
+	return ctxt.VCS.Commit(message, paths...)
+}
+
+func commitMessage(header string, req *move.Req) string {
+	var b bytes.Buffer
+	b.WriteString(header)
+
+	stat := req.Stat()
+	fmt.Fprintf(&b, "\nrewritten files:\n")
+	for _, path := range sortedKeys(stat) {
+		fmt.Fprintf(&b, "- %s: %d\n", path, stat[path])
+	}
+
+	if len(req.Conflicts) > 0 {
+		fmt.Fprintf(&b, "\nconflicts:\n")
+		for _, msg := range req.Conflicts {
+			fmt.Fprintf(&b, "- %s\n", msg)
+		}
+	}
+	return b.String()
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// verify type checks the moved package and the affected packages again, the paths of pkgs are converted by rename
+// (in syntactic mode, existed is nil, so all errors after moving are reported)
+func verify(ctxt *build.Context, c *load.Config, root *collect.Target, existed []load.Error, pkgs []string, rename func(string) string) error {
+	log.Println("verifying..")
+	errs, err := c.Verify(ctxt, root, existed, pkgs, rename)
 	if err != nil {
-		return errors.Errorf("invalid source %s", option.fromPkg)
+		return err
 	}
-	dsttarget, err := collect.TargetRoot(ctxt, option.toPkg)
+	if len(errs) == 0 {
+		log.Println("ok, no errors are introduced")
+		return nil
+	}
+	for _, e := range errs {
+		log.Printf("introduced: %s", e)
+	}
+	return errors.Errorf("%d errors are introduced by the move", len(errs))
+}
+
+// preflight checks that the working tree is clean (a mechanical move is never mixed with hand edits)
+func preflight(ctxt *build.Context, paths ...string) error {
+	changes, err := ctxt.VCS.Status(paths...)
 	if err != nil {
-		dsttarget = &collect.Target{
-			Dir:        srctarget.Dir,
-			Pkg:        option.toPkg,
-			Path:       ctxt.JoinPath(srctarget.Dir, option.toPkg),
-			NeedCreate: true,
-		}
+		return err
 	}
+	if len(changes) == 0 {
+		return nil
+	}
+	for _, change := range changes {
+		log.Printf("uncommitted: %s", change)
+	}
+	return errors.Errorf("working tree has %d uncommitted changes (--force to run anyway)", len(changes))
+}
 
+// write writes the files (and releases them)
+func write(ctxt *build.Context, fset *token.FileSet, req *move.Req, option *option) error {
 	pp := &printer.Config{Tabwidth: 8, Mode: printer.UseSpaces | printer.TabIndent}
 
-	stat := map[*types.Package]int{}
-	for f, pw := range req.WillBeWrite {
+	return req.Flush(func(f *token.File, pw *move.PreWrite) error {
 		var b bytes.Buffer
-		if err := pp.Fprint(&b, prog.Fset, pw.File); err != nil {
+		if err := pp.Fprint(&b, fset, pw.File); err != nil {
 			return err
 		}
 
@@ -199,12 +561,19 @@ func run(ctxt *build.Context, option *option) error {
 		if option.verbose {
 			log.Printf("write file %s", f.Name())
 		}
-		stat[pw.Pkg]++
-	}
-	for pkg, count := range stat {
-		log.Printf("write %s, files=%d", pkg.Path(), count)
+		return nil
+	})
+}
+
+func logStat(req *move.Req) {
+	stat := req.Stat()
+	for _, path := range sortedKeys(stat) {
+		log.Printf("write %s, files=%d", path, stat[path])
 	}
+}
 
+// movePackage moves the package
+func movePackage(ctxt *build.Context, srctarget, dsttarget *collect.Target) error {
 	if dsttarget.NeedCreate {
 		if err := ctxt.MkdirAll(filepath.Dir(dsttarget.Path)); err != nil {
 			return err
@@ -212,38 +581,78 @@ func run(ctxt *build.Context, option *option) error {
 	}
 
 	log.Printf("move package %s -> %s", srctarget.Pkg, dsttarget.Pkg)
-	if err := ctxt.MoveFile(srctarget.Path, dsttarget.Path); err != nil {
+	if err := ctxt.MovePackage(srctarget.Path, dsttarget.Path); err != nil {
 		return err
 	}
 	return nil
 }
 
-func unsafeOptimization(c *loader.Config, option *option, affected []collect.Affected) {
-	if !option.verbose {
-		c.TypeChecker.Error = func(e error) {} // silent
+// mergePackage moves the files of the package into the existing destination
+func mergePackage(ctxt *build.Context, srctarget, dsttarget *collect.Target, option *option) error {
+	log.Printf("merge package %s -> %s", srctarget.Pkg, dsttarget.Pkg)
+	if option.only {
+		return ctxt.MovePackage(srctarget.Path, dsttarget.Path) // only go files are moved
 	}
 
-	c.AllowErrors = true
-	shallowImports := map[string]bool{
-		option.fromPkg: true,
+	fs, err := ctxt.ReadDir(srctarget.Path)
+	if err != nil {
+		return err
 	}
-	for _, a := range affected {
-		shallowImports[a.Pkg] = true
-		for k := range a.ShallowImports {
-			shallowImports[k] = true
+	for _, f := range fs {
+		if err := ctxt.Move(ctxt.JoinPath(srctarget.Path, f.Name()), ctxt.JoinPath(dsttarget.Path, f.Name())); err != nil {
+			return err
 		}
 	}
+	if fs, err := ctxt.ReadDir(srctarget.Path); err == nil && len(fs) == 0 {
+		return ctxt.RemoveAll(srctarget.Path)
+	}
+	return nil
+}
 
-	c.FindPackage = func(ctxt *build.OriginalContext, importPath, fromDir string, mode build.ImportMode) (*build.Package, error) {
-		if _, ok := shallowImports[importPath]; !ok {
-			bp := &build.Package{
-				ImportPath: importPath,
-			}
-			err := &build.NoGoError{
-				Dir: importPath,
-			}
-			return bp, err
+// hasGoFiles reports whether the directory includes go files (an existing package)
+func hasGoFiles(ctxt *build.Context, dir string) bool {
+	fs, err := ctxt.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, f := range fs {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".go") {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeConflicts returns the files (or directories) existed in both the source and the destination
+func mergeConflicts(ctxt *build.Context, srctarget, dsttarget *collect.Target, option *option) []string {
+	fs, err := ctxt.ReadDir(dsttarget.Path)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	existed := map[string]bool{}
+	for _, f := range fs {
+		existed[f.Name()] = true
+	}
+
+	fs, err = ctxt.ReadDir(srctarget.Path)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	var conflicts []string
+	for _, f := range fs {
+		if option.only && (f.IsDir() || !strings.HasSuffix(f.Name(), ".go")) {
+			continue // not moved
+		}
+		if existed[f.Name()] {
+			conflicts = append(conflicts, fmt.Sprintf("collision: %s is existed in both %s and %s", f.Name(), srctarget.Path, dsttarget.Path))
 		}
-		return ctxt.Import(importPath, fromDir, mode)
 	}
+	return conflicts
+}
+
+func conflictError(conflicts []string) error {
+	for _, msg := range conflicts {
+		log.Printf("conflict: %s", msg)
+	}
+	return errors.Errorf("cannot merge, %d conflicts are found", len(conflicts))
 }
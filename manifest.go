@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/token"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/podhmo/gomvpkg-light/build"
+	"github.com/podhmo/gomvpkg-light/collect"
+	"github.com/podhmo/gomvpkg-light/move"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Manifest : the moves applied at once (--manifest)
+type Manifest struct {
+	Moves []Move `json:"moves" yaml:"moves"`
+}
+
+// Move :
+type Move struct {
+	From string `json:"from" yaml:"from"`
+	To   string `json:"to" yaml:"to"`
+}
+
+// ReadManifest reads the manifest file (json or yaml, by the extension)
+func ReadManifest(filename string) (*Manifest, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "read manifest")
+	}
+
+	var m Manifest
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		err = json.Unmarshal(b, &m)
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(b, &m)
+	default:
+		return nil, errors.Errorf("unsupported manifest %s (json or yaml)", filename)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse manifest %s", filename)
+	}
+	if len(m.Moves) == 0 {
+		return nil, errors.Errorf("no moves in manifest %s", filename)
+	}
+	return &m, nil
+}
+
+// Sort validates the moves, and returns them in the order of applying.
+// the sources must not be overlapped (and the destinations must not be same). a move into the place of another
+// move's source is applied after it (cyclic moves are error), and a move into the sub package of another
+// move's destination is applied after it.
+func (m *Manifest) Sort(ctxt *build.Context) ([]Move, error) {
+	moves := m.Moves
+	for i, x := range moves {
+		if x.From == "" || x.To == "" {
+			return nil, errors.Errorf("moves[%d]: from and to are required", i)
+		}
+		if x.From == x.To {
+			return nil, errors.Errorf("moves[%d]: %s is moved to itself", i, x.From)
+		}
+		for _, y := range moves[:i] {
+			if ctxt.MatchPkg(x.From, y.From) || ctxt.MatchPkg(y.From, x.From) {
+				return nil, errors.Errorf("overlapped sources: %s and %s", y.From, x.From)
+			}
+			if x.To == y.To {
+				return nil, errors.Errorf("overlapped destinations: %s and %s", y.To, x.To)
+			}
+		}
+	}
+
+	// x must be applied before y, if y is moved into (or onto) the place of x, or under the destination of x
+	before := func(x, y Move) bool {
+		return ctxt.MatchPkg(x.From, y.To) || ctxt.MatchPkg(y.To, x.From) || (x.To != y.To && ctxt.MatchPkg(x.To, y.To))
+	}
+	deps := make([]int, len(moves))
+	for i, x := range moves {
+		for j, y := range moves {
+			if i != j && before(x, y) {
+				deps[j]++
+			}
+		}
+	}
+
+	sorted := make([]Move, 0, len(moves))
+	done := make([]bool, len(moves))
+	for len(sorted) < len(moves) {
+		progress := false
+		for i, x := range moves {
+			if done[i] || deps[i] > 0 {
+				continue
+			}
+			done[i] = true
+			progress = true
+			sorted = append(sorted, x)
+			for j, y := range moves {
+				if i != j && before(x, y) {
+					deps[j]--
+				}
+			}
+			break // keeping the order of the manifest, as much as possible
+		}
+		if !progress {
+			var cyclic []string
+			for i, x := range moves {
+				if !done[i] {
+					cyclic = append(cyclic, x.From+" -> "+x.To)
+				}
+			}
+			return nil, errors.Errorf("cyclic moves: %s", strings.Join(cyclic, ", "))
+		}
+	}
+	return sorted, nil
+}
+
+// Rename converts an import path before moving to the one after moving
+func (m *Manifest) Rename(ctxt *build.Context, path string) string {
+	for _, x := range m.Moves {
+		if ctxt.MatchPkg(x.From, path) {
+			return ctxt.RenamePkg(x.From, x.To, path)
+		}
+	}
+	return path
+}
+
+// runManifest applies the moves of the manifest file
+func runManifest(ctxt *build.Context, option *option) error {
+	log.Printf("start move packages (manifest %s)", option.manifest)
+	return runMoves(ctxt, option, func(root *collect.Target, pkgdirs []string) (*Manifest, error) {
+		return ReadManifest(option.manifest)
+	})
+}
+
+// runMoves applies the moves at once (the packages are loaded once, and the files are written in one pass).
+// manifestOf returns the moves, from the candidate directories.
+func runMoves(ctxt *build.Context, option *option, manifestOf func(root *collect.Target, pkgdirs []string) (*Manifest, error)) error {
+	defer logElapsed(time.Now())
+
+	if option.syntactic || option.batch > 0 {
+		log.Println("syntactic and batch options are ignored with many moves")
+	}
+
+	s, err := newSession(ctxt, option)
+	if err != nil {
+		return err
+	}
+	if err := s.collect(); err != nil {
+		return err
+	}
+
+	manifest, err := manifestOf(s.root, s.pkgdirs)
+	if err != nil {
+		return err
+	}
+	moves, err := manifest.Sort(ctxt)
+	if err != nil {
+		return err
+	}
+	for _, x := range moves {
+		log.Printf("planned %s -> %s", x.From, x.To)
+	}
+
+	var srcs, dsts []*collect.Target
+	var paths, froms []string
+	for _, x := range moves {
+		src, err := collect.TargetRoot(ctxt, x.From)
+		if err != nil {
+			return errors.Errorf("invalid source %s", x.From)
+		}
+		dst, err := collect.TargetRoot(ctxt, x.To)
+		if err != nil || vacated(ctxt, moves, x.To) {
+			if dst, err = collect.NewTarget(ctxt, src, x.To); err != nil {
+				return errors.Wrap(err, "invalid destination")
+			}
+		} else {
+			return errors.Errorf("%s is existed (merging is not supported with many moves)", x.To)
+		}
+		srcs = append(srcs, src)
+		dsts = append(dsts, dst)
+		paths = append(paths, src.Path, dst.Path)
+		froms = append(froms, x.From)
+	}
+
+	// the sub packages moved with x must not be the place of another move into the destination of x
+	for i, x := range moves {
+		for _, y := range moves {
+			if x.To != y.To && ctxt.MatchPkg(x.To, y.To) && ctxt.IsDir(ctxt.JoinPath(srcs[i].Path, strings.TrimPrefix(y.To, x.To+"/"))) {
+				return errors.Errorf("%s is existed after moving %s -> %s", y.To, x.From, x.To)
+			}
+		}
+	}
+
+	if err := s.preflight(paths...); err != nil {
+		return err
+	}
+	affected, err := s.affected(froms...)
+	if err != nil {
+		return err
+	}
+
+	willBeWrite := map[*token.File]*move.PreWrite{}
+	var pkgs []string
+	var reqs []*move.Req
+	for i, x := range moves {
+		pkgs = append(pkgs, x.From)
+		for _, a := range affected[i] {
+			pkgs = append(pkgs, strings.TrimSuffix(a.Pkg, "_test"))
+		}
+
+		req := &move.Req{
+			FromPkg:     x.From,
+			ToPkg:       x.To,
+			InPkg:       option.inPkg,
+			Root:        s.root,
+			Affected:    affected[i],
+			WillBeWrite: willBeWrite, // shared, a file is rewritten by the moves in order
+			Verbose:     option.verbose,
+		}
+		if vacated(ctxt, moves, x.To) {
+			elems := strings.Split(x.To, "/")
+			req.ToName = elems[len(elems)-1]
+		}
+		reqs = append(reqs, req)
+	}
+
+	prog, err := s.load(pkgs)
+	if err != nil {
+		return err
+	}
+
+	all := &move.Req{Root: s.root, WillBeWrite: willBeWrite}
+	for _, req := range reqs {
+		if err := targetPackage(prog, req); err != nil {
+			return err
+		}
+		if err := move.AffectedPackages(ctxt, prog, req); err != nil {
+			return err
+		}
+		all.Conflicts = append(all.Conflicts, req.Conflicts...)
+	}
+
+	err = s.transact(func(wctxt *build.Context) error {
+		if err := write(wctxt, prog.Fset, all, option); err != nil {
+			return err
+		}
+		logStat(all)
+		for i := range srcs {
+			if err := movePackage(wctxt, srcs[i], dsts[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "move %d packages\n\n", len(moves))
+	for _, x := range moves {
+		fmt.Fprintf(&b, "- %s -> %s\n", x.From, x.To)
+	}
+	return s.finish(&result{
+		existed: prog.Errors(),
+		pkgs:    pkgs,
+		rename: func(path string) string {
+			return manifest.Rename(ctxt, path)
+		},
+		req:    all,
+		header: b.String(),
+		srcs:   srcs,
+		dsts:   dsts,
+	})
+}
+
+// vacated reports whether the place of path is moved away by another move
+func vacated(ctxt *build.Context, moves []Move, path string) bool {
+	for _, x := range moves {
+		if ctxt.MatchPkg(x.From, path) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,63 +1,62 @@
 package move
 
 import (
+	"fmt"
 	"go/ast"
+	"go/token"
 	"go/types"
 	"log"
 	"path/filepath"
 	"strconv"
-	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/podhmo/gomvpkg-light/build"
 	"github.com/podhmo/gomvpkg-light/collect"
+	"github.com/podhmo/gomvpkg-light/load"
 	"golang.org/x/tools/go/ast/astutil"
-	"golang.org/x/tools/go/loader"
 )
 
 // AffectedPackages :
-func AffectedPackages(ctxt *build.Context, prog *loader.Program, req *Req) error {
+func AffectedPackages(ctxt *build.Context, prog *load.Program, req *Req) error {
 	/*
-		memo(TODO):
+		memo:
 				- unnamed import -> need to replace
-				- named import -> don't need to replace
-				- named import, but same name of calculated from frompkg -> replace
-				- another same name import is existed -> conflict(error?)
-				- another same name import is existed (named import) -> conflict
+				- named import -> don't need to replace (only the path is rewritten)
+				- named import, but same name of calculated from frompkg -> replace (the name is also renamed)
+				- another same name import is existed -> conflict (aliased, e.g. bar2)
+				- another same name import is existed (named import) -> conflict (aliased, e.g. bar2)
 	*/
+	m, err := newMover(ctxt, prog, req)
+	if err != nil {
+		return err
+	}
+	for _, a := range req.Affected {
+		if err := m.apply(&a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newMover(ctxt *build.Context, prog *load.Program, req *Req) (*mover, error) {
 	frominfo := prog.Package(req.FromPkg)
 	if frominfo == nil {
-		return errors.Errorf("not found pkg %s", req.FromPkg)
-	}
-	frompkg := frominfo.Pkg
-
-	var topkg *types.Package
-	toinfo := prog.Package(req.ToPkg)
-	if toinfo == nil {
-		elems := strings.Split(req.ToPkg, "/")
-		topkg = types.NewPackage(req.ToPkg, elems[len(elems)-1])
-	} else {
-		topkg = toinfo.Pkg
+		return nil, errors.Errorf("not found pkg %s", req.FromPkg)
 	}
+	frompkg := frominfo.Types
 
-	m := &mover{
+	return &mover{
 		ctxt:    ctxt,
 		prog:    prog,
 		req:     req,
 		frompkg: frompkg,
-		topkg:   topkg,
-	}
-	for _, a := range req.Affected {
-		if err := m.apply(&a); err != nil {
-			return err
-		}
-	}
-	return nil
+		topkg:   req.toPackage(prog),
+	}, nil
 }
 
 type mover struct {
 	ctxt    *build.Context
-	prog    *loader.Program
+	prog    *load.Program
 	req     *Req
 	frompkg *types.Package
 	topkg   *types.Package
@@ -71,7 +70,7 @@ func (m *mover) apply(a *collect.Affected) error {
 
 	fset := m.prog.Fset
 	fileMap := map[string]*ast.File{}
-	for _, f := range info.Files {
+	for _, f := range info.Syntax {
 		f := f
 		name := filepath.Base(fset.File(f.Pos()).Name())
 		fileMap[name] = f
@@ -84,89 +83,145 @@ func (m *mover) apply(a *collect.Affected) error {
 			continue
 		}
 
-		importName := m.frompkg.Name()
-		var rewriteImportCandidates []string
-
-		seen := map[string][]string{}
-
-		for _, is := range f.Imports {
-			var name string
+		im, err := scanImports(m.ctxt, info.TypesInfo, f, m.frompkg, m.topkg)
+		if err != nil {
+			return errors.Wrapf(err, "in %q", fname)
+		}
+		newName := m.topkg.Name()
 
-			path, err := strconv.Unquote(is.Path.Value)
+		if m.req.Merge {
+			merged, err := m.merge(info, f)
 			if err != nil {
-				return errors.Errorf("invalid path %s, in %q", err, fname)
+				return err
 			}
-
-			if is.Name != nil {
-				name = is.Name.Name
-				if path == m.frompkg.Path() {
-					importName = is.Name.Name
-				}
-			} else {
-				items := strings.Split(path, "/")
-				name = items[len(items)-1]
-			}
-
-			if m.ctxt.MatchPkg(m.frompkg.Path(), path) {
-				rewriteImportCandidates = append(rewriteImportCandidates, path)
-				if m.frompkg.Path() == path {
-					name = m.topkg.Name()
-				}
-				seen[name] = append(seen[name], strings.Replace(path, m.frompkg.Path(), m.topkg.Path(), 1))
-			} else {
-				seen[name] = append(seen[name], path)
+			if merged {
+				im.importsFrom = false // the import of frompkg is removed
 			}
 		}
 
-		skip := false
-
-		if importName != m.frompkg.Name() {
-			skip = true
-		}
-
-		if vs, _ := seen[m.topkg.Name()]; len(vs) > 1 {
-			log.Printf("conflict: %s in (in %s/%s)", vs, a.Pkg, fname)
-			skip = true
-		}
-
-		// todo : check
-		if !skip {
-			ast.Inspect(f, func(node ast.Node) bool {
-				if t, _ := node.(*ast.SelectorExpr); t != nil {
-					ob := info.ObjectOf(t.Sel)
-					if ob == nil {
-						if m.req.Verbose {
-							log.Printf("affected package, inspect, %q is nil (in %s/%s)", t.Sel, a.Pkg, fname)
-						}
-						return true
-					}
-					pkg := ob.Pkg()
-					if m.frompkg == pkg || info.Pkg == pkg { // xxx: for embeded (info.Pkg == pkg)
-						ast.Inspect(t.X, func(node ast.Node) bool {
-							if ident, _ := node.(*ast.Ident); ident != nil {
-								if ident.Name == importName && ident.Obj == nil {
-									ident.Name = m.topkg.Name()
-								}
-							}
-							return true
-						})
-						return false
-					}
+		if im.importsFrom {
+			var uses []*ast.Ident
+			for _, ident := range usesOf(info.TypesInfo, f, m.frompkg.Path()) {
+				if ident.Name == im.importName {
+					uses = append(uses, ident) // another aliased import of the same package is not renamed
 				}
-				return true
-			})
+			}
+			if vs, _ := im.seen[newName]; len(vs) > 1 {
+				newName = alias(newName, im.seen, info.Types, info.TypesInfo, f, m.topkg.Path(), uses)
+				m.req.conflict("conflict: the name %s is used by %s (in %s/%s), %q is imported as %s", m.topkg.Name(), vs, a.Pkg, fname, m.topkg.Path(), newName)
+			} else if shadowed(info.Types, info.TypesInfo, f, newName, m.topkg.Path(), uses) {
+				newName = alias(newName, im.seen, info.Types, info.TypesInfo, f, m.topkg.Path(), uses)
+				m.req.conflict("shadowed: %s is declared (in %s/%s), %q is imported as %s", m.topkg.Name(), a.Pkg, fname, m.topkg.Path(), newName)
+			}
 
+			for _, ident := range uses {
+				ident.Name = newName
+			}
 		}
 
-		for _, path := range rewriteImportCandidates {
-			astutil.RewriteImport(fset, f, path, strings.Replace(path, m.frompkg.Path(), m.topkg.Path(), 1))
+		if m.req.FromPkg == m.req.ToPkg && !im.importsFrom {
+			continue // only the package name is renamed, and the import is aliased (nothing is changed)
 		}
+		rewriteImports(m.ctxt, fset, f, im, m.frompkg, m.topkg, newName)
 
 		k := fset.File(f.Pos())
 		m.req.WillBeWrite[k] = &PreWrite{
-			Pkg:  info.Pkg,
+			Pkg:  info.Types,
 			File: f,
 		}
 	}
 	return nil
 }
+
+// imports : the imports of a file, related to the moving package
+type imports struct {
+	importName  string              // the name of frompkg in the file
+	importsFrom bool                // imported as unnamed import (or named import, same name of frompkg)
+	candidates  []string            // import paths to be rewritten (including sub packages)
+	seen        map[string][]string // name -> import paths (after moving)
+}
+
+// scanImports scans the imports of the file (info is nil, in syntactic mode)
+func scanImports(ctxt *build.Context, info *types.Info, f *ast.File, frompkg, topkg *types.Package) (*imports, error) {
+	im := &imports{
+		importName: frompkg.Name(),
+		seen:       map[string][]string{},
+	}
+
+	for _, is := range f.Imports {
+		path, err := strconv.Unquote(is.Path.Value)
+		if err != nil {
+			return nil, errors.Errorf("invalid path %s", err)
+		}
+
+		name := importedName(info, is)
+		if is.Name != nil && path == frompkg.Path() && !im.importsFrom {
+			im.importName = is.Name.Name
+		}
+
+		if ctxt.MatchPkg(frompkg.Path(), path) {
+			im.candidates = append(im.candidates, path)
+			// another aliased import of the same package is kept as is
+			if frompkg.Path() == path && (is.Name == nil || is.Name.Name == frompkg.Name()) {
+				name = topkg.Name()
+				im.importName = frompkg.Name()
+				im.importsFrom = true
+			}
+			path = ctxt.RenamePkg(frompkg.Path(), topkg.Path(), path)
+		}
+		if name == "_" || name == "." {
+			continue
+		}
+		im.seen[name] = append(im.seen[name], path)
+	}
+	return im, nil
+}
+
+// rewriteImports rewrites the import paths, and the name of the import (if aliased or named)
+func rewriteImports(ctxt *build.Context, fset *token.FileSet, f *ast.File, im *imports, frompkg, topkg *types.Package, newName string) {
+	for _, path := range im.candidates {
+		astutil.RewriteImport(fset, f, path, ctxt.RenamePkg(frompkg.Path(), topkg.Path(), path))
+	}
+	if im.importsFrom && (newName != topkg.Name() || hasImportName(f, topkg.Path(), frompkg.Name())) {
+		if newName == topkg.Name() && newName == pathName(topkg.Path()) {
+			newName = "" // not import bar "bar"
+		}
+		setImportName(f, topkg.Path(), frompkg.Name(), newName)
+	}
+}
+
+// alias returns the name not used in the file (e.g. bar2, bar3, ...)
+func alias(name string, seen map[string][]string, pkg *types.Package, info *types.Info, f *ast.File, path string, uses []*ast.Ident) string {
+	for i := 2; ; i++ {
+		candidate := fmt.Sprintf("%s%d", name, i)
+		if _, ok := seen[candidate]; ok {
+			continue
+		}
+		if shadowed(pkg, info, f, candidate, path, uses) {
+			continue
+		}
+		return candidate
+	}
+}
+
+// setImportName changes the import of path (unnamed, or named as old) to the named import (if name is empty, unnamed)
+func setImportName(f *ast.File, path string, old string, name string) {
+	for _, is := range f.Imports {
+		if v, err := strconv.Unquote(is.Path.Value); err == nil && v == path && (is.Name == nil || is.Name.Name == old) {
+			if name == "" {
+				is.Name = nil
+			} else {
+				is.Name = &ast.Ident{NamePos: is.Path.Pos(), Name: name}
+			}
+		}
+	}
+}
+
+func hasImportName(f *ast.File, path string, name string) bool {
+	for _, is := range f.Imports {
+		if v, err := strconv.Unquote(is.Path.Value); err == nil && v == path && is.Name != nil && is.Name.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,451 @@
+package move
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"log"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/podhmo/gomvpkg-light/load"
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// declUnit : a moved declaration (a function, or a spec of a general declaration)
+type declUnit struct {
+	file *ast.File
+	decl ast.Decl
+	spec ast.Spec // nil, if the whole declaration is moved
+}
+
+func (u *declUnit) Pos() token.Pos {
+	if u.spec != nil {
+		return specPos(u.spec)
+	}
+	if doc := declDoc(u.decl); doc != nil {
+		return doc.Pos()
+	}
+	return u.decl.Pos()
+}
+
+func (u *declUnit) End() token.Pos {
+	if u.spec != nil {
+		if comment := specComment(u.spec); comment != nil {
+			return comment.End()
+		}
+		return u.spec.End()
+	}
+	return u.decl.End()
+}
+
+// SplitDecls : the package-level declarations of FromPkg (names) are moved,
+// with the methods of the moved types, and the unexported helpers used only by them
+func SplitDecls(prog *load.Program, req *Req, names []string) (*Split, error) {
+	from := prog.Package(req.FromPkg)
+	if from == nil {
+		return nil, errors.Errorf("not found pkg %s", req.FromPkg)
+	}
+
+	selected := map[string]bool{}
+	for _, name := range names {
+		ob := from.Types.Scope().Lookup(name)
+		if ob == nil {
+			return nil, errors.Errorf("%s is not declared in %s", name, req.FromPkg)
+		}
+		selected[name] = true
+	}
+
+	var units []*declUnit
+	inMoved := func(pos token.Pos) bool {
+		for _, u := range units {
+			if u.Pos() <= pos && pos < u.End() {
+				return true
+			}
+		}
+		return false
+	}
+
+	// the unexported helpers are pulled along, until no more helpers are found
+	for {
+		units = collectUnits(from.Syntax, selected)
+
+		uses := map[types.Object][]token.Pos{}
+		for ident, ob := range from.TypesInfo.Uses {
+			if ob.Pkg() == from.Types && ob.Parent() == ob.Pkg().Scope() {
+				uses[ob] = append(uses[ob], ident.Pos())
+			}
+		}
+		found := false
+		for ob, positions := range uses {
+			if selected[ob.Name()] || ob.Exported() {
+				continue
+			}
+			used := false
+			helper := true
+			for _, pos := range positions {
+				if inMoved(pos) {
+					used = true
+				} else if !within(ob, pos, from.Syntax) {
+					helper = false
+				}
+			}
+			if used && helper {
+				log.Printf("%s is moved with the declarations (helper)", ob.Name())
+				selected[ob.Name()] = true
+				found = true
+			}
+		}
+		if !found {
+			break
+		}
+	}
+
+	s, err := NewSplit(prog, req, inMoved)
+	if err != nil {
+		return nil, err
+	}
+	s.units = units
+	return s, nil
+}
+
+// collectUnits returns the declarations of the selected names (and the methods of the selected types)
+func collectUnits(files []*ast.File, selected map[string]bool) []*declUnit {
+	var units []*declUnit
+	for _, f := range files {
+		for _, decl := range f.Decls {
+			switch decl := decl.(type) {
+			case *ast.FuncDecl:
+				name := decl.Name.Name
+				if decl.Recv != nil {
+					name = receiverName(decl)
+				}
+				if selected[name] {
+					units = append(units, &declUnit{file: f, decl: decl})
+				}
+			case *ast.GenDecl:
+				var specs []ast.Spec
+				for _, spec := range decl.Specs {
+					switch spec := spec.(type) {
+					case *ast.TypeSpec:
+						if selected[spec.Name.Name] {
+							specs = append(specs, spec)
+						}
+					case *ast.ValueSpec:
+						for _, name := range spec.Names {
+							if selected[name.Name] {
+								specs = append(specs, spec)
+								break
+							}
+						}
+					}
+				}
+				if len(specs) == 0 {
+					continue
+				}
+				if len(specs) < len(decl.Specs) && positional(decl) {
+					// the values depend on the position in the group, the constants are moved together
+					for _, spec := range decl.Specs {
+						for _, name := range spec.(*ast.ValueSpec).Names {
+							if !selected[name.Name] {
+								log.Printf("%s is moved with the declarations (the same const group)", name.Name)
+								selected[name.Name] = true
+							}
+						}
+					}
+					specs = decl.Specs
+				}
+				if len(specs) == len(decl.Specs) {
+					units = append(units, &declUnit{file: f, decl: decl})
+					continue
+				}
+				for _, spec := range specs {
+					units = append(units, &declUnit{file: f, decl: decl, spec: spec})
+				}
+			}
+		}
+	}
+	return units
+}
+
+// positional reports whether the values of the const group depend on the position of the specs (iota, or the omitted values)
+func positional(decl *ast.GenDecl) bool {
+	if decl.Tok != token.CONST {
+		return false
+	}
+	found := false
+	for _, spec := range decl.Specs {
+		spec := spec.(*ast.ValueSpec)
+		if len(spec.Values) == 0 {
+			return true
+		}
+		for _, v := range spec.Values {
+			ast.Inspect(v, func(node ast.Node) bool {
+				if ident, _ := node.(*ast.Ident); ident != nil && ident.Name == "iota" {
+					found = true
+				}
+				return !found
+			})
+		}
+	}
+	return found
+}
+
+// within reports whether the position is in the declaration of ob (e.g. recursive function)
+func within(ob types.Object, pos token.Pos, files []*ast.File) bool {
+	for _, f := range files {
+		if f.Pos() <= ob.Pos() && ob.Pos() < f.End() {
+			path, _ := astutil.PathEnclosingInterval(f, ob.Pos(), ob.Pos())
+			for _, node := range path {
+				switch node.(type) {
+				case *ast.FuncDecl, *ast.ValueSpec, *ast.TypeSpec:
+					return node.Pos() <= pos && pos < node.End()
+				}
+			}
+		}
+	}
+	return false
+}
+
+// declFile returns the name of the file created in ToPkg (same name of the file including the declarations.
+// if existed, prefixed by the name of FromPkg, e.g. foo_a.go, keeping the suffix such as _test.go)
+func declFile(fname string, prefix string, existed func(fname string) bool) string {
+	if !existed(fname) {
+		return fname
+	}
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s_%s", prefix, fname)
+		if i > 1 {
+			candidate = fmt.Sprintf("%s%d_%s", prefix, i, fname)
+		}
+		if !existed(candidate) {
+			return candidate
+		}
+	}
+}
+
+// ExtractDecls cuts the moved declarations out of the files of FromPkg, into the new files placed in dir
+// (the imports used by the declarations are copied, and the unused imports are removed).
+// existed reports whether the file is existed in dir (the created files are not overwritten)
+func (s *Split) ExtractDecls(dir string, existed func(fname string) bool) error {
+	if len(s.units) == 0 {
+		return errors.New("no declarations are moved")
+	}
+	if s.created == nil {
+		s.created = map[*ast.File]bool{}
+	}
+
+	byFile := map[*ast.File][]*declUnit{}
+	var files []*ast.File
+	for _, u := range s.units {
+		if _, ok := byFile[u.file]; !ok {
+			files = append(files, u.file)
+		}
+		byFile[u.file] = append(byFile[u.file], u)
+	}
+
+	fset := s.Prog.Fset
+	created := map[string]bool{}
+	for _, f := range files {
+		units := byFile[f]
+		k := fset.File(f.Pos())
+		fname := declFile(filepath.Base(k.Name()), s.from.Types.Name(), func(fname string) bool {
+			return created[fname] || existed(fname)
+		})
+		if fname != filepath.Base(k.Name()) {
+			log.Printf("%s is existed in %s, the declarations are placed in %s", filepath.Base(k.Name()), s.Req.ToPkg, fname)
+		}
+		created[fname] = true
+		nf := &ast.File{
+			Package: f.Package, // the positions of the moved declarations are in the original file
+			Name:    &ast.Ident{NamePos: f.Name.NamePos, Name: s.topkg.Name()},
+		}
+
+		// the ranges are kept before rewriting (the doc comments are moved)
+		ranges := make([][2]token.Pos, len(units))
+		for i, u := range units {
+			ranges[i] = [2]token.Pos{u.Pos(), u.End()}
+		}
+		in := func(pos token.Pos) bool {
+			for _, r := range ranges {
+				if r[0] <= pos && pos < r[1] {
+					return true
+				}
+			}
+			return false
+		}
+
+		// declarations
+		wholes := map[ast.Decl]bool{}
+		parts := map[ast.Spec]bool{}
+		for _, u := range units {
+			if u.spec == nil {
+				wholes[u.decl] = true
+			} else {
+				parts[u.spec] = true
+			}
+		}
+		var decls []ast.Decl
+		for _, decl := range f.Decls {
+			if wholes[decl] {
+				nf.Decls = append(nf.Decls, decl)
+				continue
+			}
+			gen, _ := decl.(*ast.GenDecl)
+			if gen == nil {
+				decls = append(decls, decl)
+				continue
+			}
+
+			// a part of the specs is moved
+			moved := &ast.GenDecl{Tok: gen.Tok, TokPos: gen.TokPos}
+			var specs []ast.Spec
+			for _, spec := range gen.Specs {
+				if parts[spec] {
+					moved.Specs = append(moved.Specs, spec)
+				} else {
+					specs = append(specs, spec)
+				}
+			}
+			if len(moved.Specs) > 0 {
+				if len(moved.Specs) == 1 {
+					// const X = ... (the doc comment is placed before the keyword)
+					spec := moved.Specs[0]
+					moved.Doc, moved.TokPos = specDoc(spec), spec.Pos()
+					setSpecDoc(spec, nil)
+				} else {
+					moved.TokPos = lineAbove(fset, specPos(moved.Specs[0]))
+					last := &declUnit{decl: gen, spec: moved.Specs[len(moved.Specs)-1]}
+					moved.Lparen, moved.Rparen = moved.TokPos, last.End()
+				}
+				if gen.Specs[0] != specs[0] {
+					gen.Lparen = lineAbove(fset, specPos(specs[0])) // no blank line after the parenthesis
+				}
+				gen.Specs = specs
+				nf.Decls = append(nf.Decls, moved)
+			}
+			decls = append(decls, gen)
+		}
+		f.Decls = decls
+
+		// comments
+		var comments []*ast.CommentGroup
+		for _, cg := range f.Comments {
+			if in(cg.Pos()) {
+				nf.Comments = append(nf.Comments, cg)
+			} else {
+				comments = append(comments, cg)
+			}
+		}
+		f.Comments = comments
+
+		// imports
+		info := s.from.TypesInfo
+		var unused []*ast.ImportSpec
+		for _, is := range f.Imports {
+			var pkgname types.Object
+			if is.Name != nil {
+				pkgname = info.Defs[is.Name]
+			} else {
+				pkgname = info.Implicits[is]
+			}
+			usedIn, usedOut := false, false
+			for ident, ob := range info.Uses {
+				if ob != nil && ob == pkgname {
+					if in(ident.Pos()) {
+						usedIn = true
+					} else if f.Pos() <= ident.Pos() && ident.Pos() < f.End() {
+						usedOut = true
+					}
+				}
+			}
+			if usedIn {
+				path, _ := strconv.Unquote(is.Path.Value)
+				astutil.AddNamedImport(fset, nf, importSpecName(is), path)
+				if !usedOut {
+					unused = append(unused, is)
+				}
+			}
+		}
+		for _, is := range unused {
+			path, _ := strconv.Unquote(is.Path.Value)
+			astutil.DeleteNamedImport(fset, f, importSpecName(is), path)
+		}
+		if len(f.Decls) == 0 {
+			log.Printf("%s has no declarations", k.Name())
+		}
+
+		// the references to ToPkg are unqualified (moved into the same package)
+		if _, ok := importName(nf, s.topkg.Path()); ok {
+			unimport(fset, s.from, nf, s.topkg.Path())
+		}
+
+		s.created[nf] = true
+		s.Req.WillBeWrite[k] = &PreWrite{Pkg: s.from.Types, File: f}
+		nk := fset.AddFile(filepath.Join(dir, fname), -1, 0)
+		s.Req.WillBeWrite[nk] = &PreWrite{Pkg: s.topkg, File: nf}
+	}
+	return nil
+}
+
+func importSpecName(is *ast.ImportSpec) string {
+	if is.Name == nil {
+		return ""
+	}
+	return is.Name.Name
+}
+
+func specDoc(spec ast.Spec) *ast.CommentGroup {
+	switch spec := spec.(type) {
+	case *ast.TypeSpec:
+		return spec.Doc
+	case *ast.ValueSpec:
+		return spec.Doc
+	}
+	return nil
+}
+
+func setSpecDoc(spec ast.Spec, doc *ast.CommentGroup) {
+	switch spec := spec.(type) {
+	case *ast.TypeSpec:
+		spec.Doc = doc
+	case *ast.ValueSpec:
+		spec.Doc = doc
+	}
+}
+
+// specPos returns the position of the spec (including the doc comment)
+func specPos(spec ast.Spec) token.Pos {
+	if doc := specDoc(spec); doc != nil {
+		return doc.Pos()
+	}
+	return spec.Pos()
+}
+
+// lineAbove returns the end of the previous line of pos
+func lineAbove(fset *token.FileSet, pos token.Pos) token.Pos {
+	file := fset.File(pos)
+	return file.LineStart(file.Line(pos)) - 1
+}
+
+func specComment(spec ast.Spec) *ast.CommentGroup {
+	switch spec := spec.(type) {
+	case *ast.TypeSpec:
+		return spec.Comment
+	case *ast.ValueSpec:
+		return spec.Comment
+	}
+	return nil
+}
+
+func declDoc(decl ast.Decl) *ast.CommentGroup {
+	switch decl := decl.(type) {
+	case *ast.FuncDecl:
+		return decl.Doc
+	case *ast.GenDecl:
+		return decl.Doc
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package move
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/podhmo/gomvpkg-light/load"
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
+)
+
+// DuplicateDecls returns the top-level declarations existed in both packages (the merge is impossible).
+// the names of the imports in each file are also checked against the top-level declarations of the other package.
+func DuplicateDecls(prog *load.Program, req *Req) []string {
+	var dups []string
+	for _, suffix := range []string{"", "_test"} {
+		from, to := prog.Package(req.FromPkg+suffix), prog.Package(req.ToPkg+suffix)
+		if from == nil || to == nil {
+			continue
+		}
+		for _, name := range from.Types.Scope().Names() {
+			if ob := to.Types.Scope().Lookup(name); ob != nil {
+				dups = append(dups, fmt.Sprintf("duplicate: %s is declared in both %s (%s) and %s (%s)",
+					name, from.PkgPath, prog.Fset.Position(from.Types.Scope().Lookup(name).Pos()), to.PkgPath, prog.Fset.Position(ob.Pos())))
+			}
+		}
+		for _, x := range [][2]*packages.Package{{from, to}, {to, from}} {
+			for _, f := range x[0].Syntax {
+				for _, is := range f.Imports {
+					name := importedName(x[0].TypesInfo, is)
+					if path, _ := strconv.Unquote(is.Path.Value); path == x[1].PkgPath || name == "_" || name == "." {
+						continue // the import of the other package is removed
+					}
+					if ob := x[1].Types.Scope().Lookup(name); ob != nil {
+						dups = append(dups, fmt.Sprintf("duplicate: %s is imported in %s (%s) and declared in %s (%s)",
+							name, x[0].PkgPath, prog.Fset.Position(is.Pos()), x[1].PkgPath, prog.Fset.Position(ob.Pos())))
+					}
+				}
+			}
+		}
+	}
+	return dups
+}
+
+// ShadowedUses returns the references between both packages, which cannot be unqualified by merging (the merge is impossible)
+func ShadowedUses(prog *load.Program, req *Req) []string {
+	var conflicts []string
+	for _, x := range [][2]string{{req.FromPkg, req.ToPkg}, {req.ToPkg, req.FromPkg}} {
+		info := prog.Package(x[0])
+		if info == nil {
+			continue
+		}
+		for _, f := range info.Syntax {
+			for _, u := range shadowedSelectors(info.Types, info.TypesInfo, f, x[1], nil) {
+				conflicts = append(conflicts, fmt.Sprintf("shadowed: %s.%s cannot be unqualified (%s), %s is declared at %s",
+					u.sel.X, u.sel.Sel.Name, prog.Fset.Position(u.sel.Pos()), u.ob.Name(), prog.Fset.Position(u.ob.Pos())))
+			}
+		}
+	}
+	return conflicts
+}
+
+// unimport removes the import of path, and the qualifiers of the uses (pkg.X -> X), for merging into the package of the file
+func unimport(fset *token.FileSet, info *packages.Package, f *ast.File, path string) {
+	uses := map[*ast.Ident]bool{}
+	for _, ident := range usesOf(info.TypesInfo, f, path) {
+		uses[ident] = true
+	}
+	astutil.Apply(f, func(c *astutil.Cursor) bool {
+		if sel, _ := c.Node().(*ast.SelectorExpr); sel != nil {
+			if ident, _ := sel.X.(*ast.Ident); ident != nil && uses[ident] {
+				c.Replace(sel.Sel)
+			}
+		}
+		return true
+	}, nil)
+	deleteImport(fset, f, path)
+}
+
+// merge rewrites the uses of frompkg in the file, for merging into topkg.
+// if the file is a part of topkg, the qualifiers are removed. if the file imports both packages,
+// the uses are renamed to the name of topkg's import (collapsed into one import).
+// returns false, if the usual rewriting is needed. if the name of topkg's import is shadowed at the uses, it is error.
+func (m *mover) merge(info *packages.Package, f *ast.File) (bool, error) {
+	fromName, ok := importName(f, m.frompkg.Path())
+	if !ok || fromName == "." {
+		return false, nil
+	}
+	if info.PkgPath == m.topkg.Path() {
+		unimport(m.prog.Fset, info, f, m.frompkg.Path())
+		return true, nil
+	}
+
+	toName, ok := importName(f, m.topkg.Path())
+	if !ok || toName == "." || toName == "_" {
+		return false, nil
+	}
+	if toName == "" {
+		toName = m.topkg.Name()
+	}
+	if fromName != "_" {
+		uses := usesOf(info.TypesInfo, f, m.frompkg.Path())
+		if shadowed(info.Types, info.TypesInfo, f, toName, m.topkg.Path(), uses) {
+			fname := filepath.Base(m.prog.Fset.File(f.Pos()).Name())
+			return false, errors.Errorf("shadowed: %s is declared (in %s/%s), the imports of %q and %q cannot be collapsed", toName, info.PkgPath, fname, m.frompkg.Path(), m.topkg.Path())
+		}
+		for _, ident := range uses {
+			ident.Name = toName
+		}
+	}
+	deleteImport(m.prog.Fset, f, m.frompkg.Path())
+	return true, nil
+}
+
+// importName returns the name of the import of path ("" if unnamed)
+func importName(f *ast.File, path string) (string, bool) {
+	for _, is := range f.Imports {
+		if v, err := strconv.Unquote(is.Path.Value); err == nil && v == path {
+			if is.Name == nil {
+				return "", true
+			}
+			return is.Name.Name, true
+		}
+	}
+	return "", false
+}
+
+func deleteImport(fset *token.FileSet, f *ast.File, path string) {
+	name, _ := importName(f, path)
+	astutil.DeleteNamedImport(fset, f, name, path)
+}
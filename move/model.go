@@ -1,22 +1,33 @@
 package move
 
 import (
+	"fmt"
 	"go/ast"
 	"go/token"
 	"go/types"
+	"log"
+	"sort"
+	"strings"
 
 	"github.com/podhmo/gomvpkg-light/collect"
+	"github.com/podhmo/gomvpkg-light/load"
 )
 
 // Req :
 type Req struct {
 	FromPkg     string
 	ToPkg       string
+	ToName      string // the package name of ToPkg (if empty, the name of the existing package or the last element of ToPkg)
+	Merge       bool   // ToPkg is existed, FromPkg is merged into it
 	InPkg       string
 	Root        *collect.Target
 	Affected    []collect.Affected
 	WillBeWrite map[*token.File]*PreWrite
+	Conflicts   []string // resolved by aliasing
 	Verbose     bool
+
+	written []string       // flushed files
+	stat    map[string]int // the number of flushed files per package
 }
 
 // PreWrite :
@@ -24,3 +35,67 @@ type PreWrite struct {
 	Pkg  *types.Package
 	File *ast.File
 }
+
+// toPackage returns the destination package (only the name and the path are used)
+func (req *Req) toPackage(prog *load.Program) *types.Package {
+	if req.ToName != "" {
+		return types.NewPackage(req.ToPkg, req.ToName)
+	}
+	if to := prog.Package(req.ToPkg); to != nil {
+		return to.Types
+	}
+	elems := strings.Split(req.ToPkg, "/")
+	return types.NewPackage(req.ToPkg, elems[len(elems)-1])
+}
+
+// SortedFiles returns the files of WillBeWrite, ordered by filename
+func (req *Req) SortedFiles() []*token.File {
+	files := make([]*token.File, 0, len(req.WillBeWrite))
+	for f := range req.WillBeWrite {
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	return files
+}
+
+func (req *Req) conflict(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Println(msg)
+	req.Conflicts = append(req.Conflicts, msg)
+}
+
+// Flush calls write with the files of WillBeWrite (ordered by filename), and releases them
+func (req *Req) Flush(write func(f *token.File, pw *PreWrite) error) error {
+	if req.stat == nil {
+		req.stat = map[string]int{}
+	}
+	for _, f := range req.SortedFiles() {
+		pw := req.WillBeWrite[f]
+		if err := write(f, pw); err != nil {
+			return err
+		}
+		req.stat[pw.Pkg.Path()]++
+		req.written = append(req.written, f.Name())
+		delete(req.WillBeWrite, f)
+	}
+	return nil
+}
+
+// Written returns the names of flushed files (ordered)
+func (req *Req) Written() []string {
+	written := append([]string{}, req.written...)
+	sort.Strings(written)
+	return written
+}
+
+// Stat returns the number of rewritten files per package (including flushed files)
+func (req *Req) Stat() map[string]int {
+	stat := map[string]int{}
+	for path, n := range req.stat {
+		stat[path] = n
+	}
+	for _, pw := range req.WillBeWrite {
+		stat[pw.Pkg.Path()]++
+	}
+	return stat
+}
@@ -0,0 +1,110 @@
+package move
+
+import (
+	"go/ast"
+	"go/types"
+	"strconv"
+)
+
+// importedName returns the name of the import in the file (if unnamed, the name of the imported package.
+// without type info, guessed from the path)
+func importedName(info *types.Info, is *ast.ImportSpec) string {
+	if is.Name != nil {
+		return is.Name.Name
+	}
+	path, _ := strconv.Unquote(is.Path.Value)
+	if info != nil {
+		// the path may be already rewritten by another move (with many moves)
+		if pkgname, _ := info.Implicits[is].(*types.PkgName); pkgname != nil && pkgname.Imported().Path() == path {
+			return pkgname.Imported().Name()
+		}
+	}
+	return pathName(path)
+}
+
+// usesOf returns the identifiers referring to the imported package (path) in the file
+func usesOf(info *types.Info, f *ast.File, path string) []*ast.Ident {
+	var uses []*ast.Ident
+	ast.Inspect(f, func(node ast.Node) bool {
+		if ident, _ := node.(*ast.Ident); ident != nil {
+			// compare by path, test variants are different *types.Package
+			if pkgname, _ := info.Uses[ident].(*types.PkgName); pkgname != nil && pkgname.Imported().Path() == path {
+				uses = append(uses, ident)
+			}
+		}
+		return true
+	})
+	return uses
+}
+
+// shadowed reports whether name cannot be used as the name of the import, in the file.
+//
+// - a local declaration (variable, parameter, ...) is found at the use sites
+// - an import of another package (not path) is found at the use sites
+// - a package-level declaration is existed
+// - an universe object (e.g. len) is used in the file
+func shadowed(pkg *types.Package, info *types.Info, f *ast.File, name string, path string, uses []*ast.Ident) bool {
+	if pkg.Scope().Lookup(name) != nil {
+		return true
+	}
+
+	for _, ident := range uses {
+		scope := pkg.Scope().Innermost(ident.Pos())
+		if scope == nil {
+			continue
+		}
+		if _, ob := scope.LookupParent(name, ident.Pos()); ob != nil {
+			if pkgname, _ := ob.(*types.PkgName); pkgname == nil || (pkgname != info.Uses[ident] && pkgname.Imported().Path() != path) {
+				return true
+			}
+		}
+	}
+
+	if ob := types.Universe.Lookup(name); ob != nil {
+		found := false
+		ast.Inspect(f, func(node ast.Node) bool {
+			if ident, _ := node.(*ast.Ident); ident != nil && info.Uses[ident] == ob {
+				found = true
+			}
+			return !found
+		})
+		return found
+	}
+	return false
+}
+
+// unqualified : a selector of the imported package, whose name is declared at the use site
+type unqualified struct {
+	sel *ast.SelectorExpr
+	ob  types.Object // the object found by the name, instead of the package's one
+}
+
+// shadowedSelectors returns the selectors of the imported package (path) in the file, which cannot be unqualified (pkg.X -> X).
+// the name is resolved to another object at the use site (a local declaration, or a file-level import).
+// the package-level declarations are not checked, here (duplicates). if filter is not nil, only the selected ones are checked.
+func shadowedSelectors(pkg *types.Package, info *types.Info, f *ast.File, path string, filter func(sel *ast.SelectorExpr) bool) []unqualified {
+	pkgnames := map[*ast.Ident]bool{}
+	for _, ident := range usesOf(info, f, path) {
+		pkgnames[ident] = true
+	}
+
+	var r []unqualified
+	ast.Inspect(f, func(node ast.Node) bool {
+		sel, _ := node.(*ast.SelectorExpr)
+		if sel == nil {
+			return true
+		}
+		if ident, _ := sel.X.(*ast.Ident); ident == nil || !pkgnames[ident] || (filter != nil && !filter(sel)) {
+			return true
+		}
+		scope := pkg.Scope().Innermost(sel.Pos())
+		if scope == nil {
+			return true
+		}
+		if _, ob := scope.LookupParent(sel.Sel.Name, sel.Pos()); ob != nil && ob.Parent() != pkg.Scope() && ob.Parent() != types.Universe {
+			r = append(r, unqualified{sel: sel, ob: ob})
+		}
+		return true
+	})
+	return r
+}
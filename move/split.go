@@ -0,0 +1,418 @@
+package move
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/podhmo/gomvpkg-light/load"
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
+)
+
+// Split : moving a part of FromPkg (the package-level declarations) into the new package ToPkg.
+// the remaining part refers to the moved declarations via the import of ToPkg (and vice versa).
+type Split struct {
+	Prog    *load.Program
+	Req     *Req
+	InMoved func(pos token.Pos) bool // reports whether the position is in the moved part
+
+	from    *packages.Package
+	topkg   *types.Package
+	moved   map[string]bool // the names of the moved package-level declarations
+	units   []*declUnit     // the moved declarations (declarations mode)
+	created map[*ast.File]bool
+}
+
+// SplitFiles : the files of FromPkg (fnames) are moved
+func SplitFiles(prog *load.Program, req *Req, fnames []string) (*Split, error) {
+	from := prog.Package(req.FromPkg)
+	if from == nil {
+		return nil, errors.Errorf("not found pkg %s", req.FromPkg)
+	}
+
+	files := map[*token.File]bool{}
+	for _, fname := range fnames {
+		found := false
+		for _, f := range from.Syntax {
+			if k := prog.Fset.File(f.Pos()); filepath.Base(k.Name()) == fname {
+				files[k] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, errors.Errorf("%s is not a file of %s (external test files cannot be split)", fname, req.FromPkg)
+		}
+	}
+	if len(files) == len(from.Syntax) {
+		return nil, errors.Errorf("all files of %s are selected (use the usual move)", req.FromPkg)
+	}
+
+	return NewSplit(prog, req, func(pos token.Pos) bool {
+		return files[prog.Fset.File(pos)]
+	})
+}
+
+// NewSplit :
+func NewSplit(prog *load.Program, req *Req, inMoved func(pos token.Pos) bool) (*Split, error) {
+	from := prog.Package(req.FromPkg)
+	if from == nil {
+		return nil, errors.Errorf("not found pkg %s", req.FromPkg)
+	}
+
+	s := &Split{
+		Prog:    prog,
+		Req:     req,
+		InMoved: inMoved,
+		from:    from,
+		topkg:   req.toPackage(prog),
+		moved:   map[string]bool{},
+	}
+	scope := from.Types.Scope()
+	for _, name := range scope.Names() {
+		if inMoved(scope.Lookup(name).Pos()) {
+			s.moved[name] = true
+		}
+	}
+	return s, nil
+}
+
+// Moved returns the names of the moved declarations (ordered)
+func (s *Split) Moved() []string {
+	names := make([]string, 0, len(s.moved))
+	for name := range s.moved {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Conflicts returns the references broken by the split (checked before rewriting).
+//
+// - an unexported declaration (or field, method) is referred across the moved part and the remaining part
+// - a method is separated from its receiver type
+// - both parts refer to each other (import cycle)
+func (s *Split) Conflicts() []string {
+	var conflicts []string
+	seen := map[string]bool{}
+	report := func(format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		if !seen[msg] {
+			seen[msg] = true
+			conflicts = append(conflicts, msg)
+		}
+	}
+
+	var toMoved, toRemaining []string
+	for _, f := range s.from.Syntax {
+		for _, decl := range f.Decls {
+			if decl, _ := decl.(*ast.FuncDecl); decl != nil && decl.Recv != nil {
+				if recv := receiverName(decl); s.InMoved(decl.Pos()) != s.moved[recv] {
+					report("method: %s.%s is separated from its receiver type (%s)", recv, decl.Name.Name, s.position(decl.Pos()))
+				}
+			}
+		}
+
+		ast.Inspect(f, func(node ast.Node) bool {
+			ident, _ := node.(*ast.Ident)
+			if ident == nil {
+				return true
+			}
+			ob := s.from.TypesInfo.Uses[ident]
+			if ob == nil || ob.Pkg() != s.from.Types || !s.isShared(ob) || s.InMoved(ident.Pos()) == s.InMoved(ob.Pos()) {
+				return true
+			}
+			if s.InMoved(ident.Pos()) {
+				toRemaining = append(toRemaining, ob.Name())
+			} else {
+				toMoved = append(toMoved, ob.Name())
+			}
+			if !ob.Exported() {
+				report("unexported: %s is declared in %s, but referred from %s", ob.Name(), s.position(ob.Pos()), s.position(ident.Pos()))
+			}
+			return true
+		})
+	}
+	if len(toMoved) > 0 && len(toRemaining) > 0 {
+		report("import cycle: the remaining part refers to %s, and the moved part refers to %s", toMoved[0], toRemaining[0])
+	}
+
+	// moving into the existing package
+	if to := s.Prog.Package(s.Req.ToPkg); to != nil {
+		for _, name := range s.Moved() {
+			if ob := to.Types.Scope().Lookup(name); ob != nil {
+				report("duplicate: %s is declared in both %s and %s (%s)", name, s.Req.FromPkg, s.Req.ToPkg, s.Prog.Fset.Position(ob.Pos()))
+			}
+		}
+		if _, ok := to.Imports[s.Req.FromPkg]; ok && len(toMoved) > 0 {
+			report("import cycle: %s imports %s, and the remaining part refers to %s", s.Req.ToPkg, s.Req.FromPkg, toMoved[0])
+		}
+		if _, ok := s.from.Imports[s.Req.ToPkg]; ok && len(toRemaining) > 0 {
+			report("import cycle: %s imports %s, and the moved part refers to %s", s.Req.FromPkg, s.Req.ToPkg, toRemaining[0])
+		}
+
+		// the references between ToPkg and the moved part are unqualified (foo.X -> X, bar.Y -> Y)
+		var shadowed []unqualified
+		for _, f := range to.Syntax {
+			shadowed = append(shadowed, shadowedSelectors(to.Types, to.TypesInfo, f, s.Req.FromPkg, func(sel *ast.SelectorExpr) bool {
+				return s.isMoved(to.TypesInfo.Uses[sel.Sel])
+			})...)
+		}
+		for _, f := range s.from.Syntax {
+			shadowed = append(shadowed, shadowedSelectors(s.from.Types, s.from.TypesInfo, f, s.Req.ToPkg, func(sel *ast.SelectorExpr) bool {
+				return s.InMoved(sel.Pos())
+			})...)
+		}
+		for _, u := range shadowed {
+			report("shadowed: %s.%s cannot be unqualified (%s), %s is declared in %s", u.sel.X, u.sel.Sel.Name, s.position(u.sel.Pos()), u.ob.Name(), s.position(u.ob.Pos()))
+		}
+	}
+	return conflicts
+}
+
+// Apply rewrites the references between both parts, and the affected packages
+// (the package clause of the moved part is not changed, here)
+func (s *Split) Apply() error {
+	for _, f := range s.from.Syntax {
+		if s.qualify(f) {
+			k := s.Prog.Fset.File(f.Pos())
+			s.Req.WillBeWrite[k] = &PreWrite{Pkg: s.from.Types, File: f}
+		}
+	}
+	for f := range s.created {
+		s.qualify(f) // already registered
+	}
+
+	for _, a := range s.Req.Affected {
+		info := s.Prog.Package(a.Pkg)
+		if info == nil {
+			return errors.Errorf("package not found %v", a.Pkg)
+		}
+		for _, f := range info.Syntax {
+			fname := filepath.Base(s.Prog.Fset.File(f.Pos()).Name())
+			if !contains(a.Files, fname) {
+				continue
+			}
+			if s.rewriteImporter(info, f, fname) {
+				k := s.Prog.Fset.File(f.Pos())
+				s.Req.WillBeWrite[k] = &PreWrite{Pkg: info.Types, File: f}
+			}
+		}
+	}
+	return nil
+}
+
+// qualify rewrites the references across both parts in the file of FromPkg (X -> bar.X), and adds the import.
+// returns true if the file is changed.
+func (s *Split) qualify(f *ast.File) bool {
+	var uses []*ast.Ident
+	ast.Inspect(f, func(node ast.Node) bool {
+		if ident, _ := node.(*ast.Ident); ident != nil {
+			if ob := s.from.TypesInfo.Uses[ident]; ob != nil && ob.Pkg() == s.from.Types && ob.Parent() == ob.Pkg().Scope() && s.InMoved(ident.Pos()) != s.InMoved(ob.Pos()) {
+				uses = append(uses, ident)
+			}
+		}
+		return true
+	})
+	if len(uses) == 0 {
+		return false
+	}
+
+	pkg := s.topkg
+	if s.InMoved(uses[0].Pos()) {
+		pkg = s.from.Types
+	}
+	name := s.importName(s.from, f, pkg, uses)
+
+	targets := map[*ast.Ident]bool{}
+	for _, ident := range uses {
+		targets[ident] = true
+	}
+	astutil.Apply(f, func(c *astutil.Cursor) bool {
+		if ident, _ := c.Node().(*ast.Ident); ident != nil && targets[ident] {
+			c.Replace(&ast.SelectorExpr{X: &ast.Ident{NamePos: ident.Pos(), Name: name}, Sel: ident})
+		}
+		return true
+	}, nil)
+	addImport(s.Prog.Fset, f, name, pkg)
+	return true
+}
+
+// rewriteImporter rewrites the selectors referring to the moved declarations (foo.X -> bar.X).
+// if all references are moved, the import of FromPkg is removed. returns true if the file is changed.
+func (s *Split) rewriteImporter(info *packages.Package, f *ast.File, fname string) bool {
+	fromName, ok := importName(f, s.Req.FromPkg)
+	if !ok {
+		return false
+	}
+	if fromName == "." {
+		s.Req.conflict("dot import: %q is not rewritten (in %s/%s)", s.Req.FromPkg, info.PkgPath, fname)
+		return false
+	}
+
+	pkgnames := map[*ast.Ident]bool{}
+	for _, ident := range usesOf(info.TypesInfo, f, s.Req.FromPkg) {
+		pkgnames[ident] = true
+	}
+	var moved []*ast.Ident
+	remaining := false
+	ast.Inspect(f, func(node ast.Node) bool {
+		if sel, _ := node.(*ast.SelectorExpr); sel != nil {
+			if ident, _ := sel.X.(*ast.Ident); ident != nil && pkgnames[ident] {
+				if s.isMoved(info.TypesInfo.Uses[sel.Sel]) {
+					moved = append(moved, ident)
+				} else {
+					remaining = true
+				}
+			}
+		}
+		return true
+	})
+	if len(moved) == 0 {
+		return false
+	}
+
+	if info.PkgPath == s.topkg.Path() {
+		// moved into the package of the file (foo.X -> X)
+		targets := map[*ast.Ident]bool{}
+		for _, ident := range moved {
+			targets[ident] = true
+		}
+		astutil.Apply(f, func(c *astutil.Cursor) bool {
+			if sel, _ := c.Node().(*ast.SelectorExpr); sel != nil {
+				if ident, _ := sel.X.(*ast.Ident); ident != nil && targets[ident] {
+					c.Replace(sel.Sel)
+				}
+			}
+			return true
+		}, nil)
+		if !remaining {
+			deleteImport(s.Prog.Fset, f, s.Req.FromPkg)
+		}
+		return true
+	}
+
+	name := s.importName(info, f, s.topkg, moved)
+	for _, ident := range moved {
+		ident.Name = name
+	}
+	if remaining {
+		addImport(s.Prog.Fset, f, name, s.topkg)
+		return true
+	}
+
+	// the import of FromPkg is replaced (keeping its position)
+	astutil.RewriteImport(s.Prog.Fset, f, s.Req.FromPkg, s.topkg.Path())
+	for _, is := range f.Imports {
+		if v, err := strconv.Unquote(is.Path.Value); err == nil && v == s.topkg.Path() {
+			is.Name = nil
+			if name != pathName(s.topkg.Path()) {
+				is.Name = &ast.Ident{NamePos: is.Path.Pos(), Name: name}
+			}
+		}
+	}
+	return true
+}
+
+// importName returns the name of the import of pkg in the file (aliased, if the name is not usable)
+func (s *Split) importName(info *packages.Package, f *ast.File, pkg *types.Package, uses []*ast.Ident) string {
+	if name, ok := importName(f, pkg.Path()); ok && name != "_" && name != "." {
+		if name == "" {
+			name = pkg.Name()
+		}
+		return name
+	}
+
+	seen := map[string][]string{}
+	for _, is := range f.Imports {
+		path, _ := strconv.Unquote(is.Path.Value)
+		name := importedName(info.TypesInfo, is)
+		seen[name] = append(seen[name], path)
+	}
+
+	name := pkg.Name()
+	if vs, _ := seen[name]; len(vs) > 0 {
+		name = alias(name, seen, info.Types, info.TypesInfo, f, pkg.Path(), uses)
+		s.Req.conflict("conflict: the name %s is used by %s (in %s), %q is imported as %s", pkg.Name(), vs, s.Prog.Fset.File(f.Pos()).Name(), pkg.Path(), name)
+	} else if shadowed(info.Types, info.TypesInfo, f, name, pkg.Path(), uses) {
+		name = alias(name, seen, info.Types, info.TypesInfo, f, pkg.Path(), uses)
+		s.Req.conflict("shadowed: %s is declared (in %s), %q is imported as %s", pkg.Name(), s.Prog.Fset.File(f.Pos()).Name(), pkg.Path(), name)
+	}
+	return name
+}
+
+// isMoved reports whether the object is a moved declaration (compared by path, see usesOf)
+func (s *Split) isMoved(ob types.Object) bool {
+	return ob != nil && ob.Pkg() != nil && ob.Pkg().Path() == s.Req.FromPkg && ob.Parent() == ob.Pkg().Scope() && s.moved[ob.Name()]
+}
+
+// isShared reports whether the object can be referred from another declaration (package-level, field or method)
+func (s *Split) isShared(ob types.Object) bool {
+	if ob.Parent() == ob.Pkg().Scope() {
+		return true
+	}
+	switch ob := ob.(type) {
+	case *types.Var:
+		return ob.IsField()
+	case *types.Func:
+		return ob.Type().(*types.Signature).Recv() != nil
+	}
+	return false
+}
+
+func (s *Split) position(pos token.Pos) string {
+	p := s.Prog.Fset.Position(pos)
+	return fmt.Sprintf("%s:%d", filepath.Base(p.Filename), p.Line)
+}
+
+// receiverName returns the name of the receiver's base type
+func receiverName(decl *ast.FuncDecl) string {
+	typ := decl.Recv.List[0].Type
+	for {
+		switch t := typ.(type) {
+		case *ast.StarExpr:
+			typ = t.X
+		case *ast.ParenExpr:
+			typ = t.X
+		case *ast.IndexExpr:
+			typ = t.X
+		case *ast.IndexListExpr:
+			typ = t.X // two or more type parameters
+		case *ast.Ident:
+			return t.Name
+		default:
+			log.Printf("unexpected receiver %T", typ)
+			return ""
+		}
+	}
+}
+
+// addImport adds the import of pkg (named, if name is not the package name)
+func addImport(fset *token.FileSet, f *ast.File, name string, pkg *types.Package) {
+	if _, ok := importName(f, pkg.Path()); ok {
+		return
+	}
+	if name == pathName(pkg.Path()) {
+		name = ""
+	}
+	astutil.AddNamedImport(fset, f, name, pkg.Path())
+}
+
+func pathName(path string) string {
+	return filepath.Base(filepath.FromSlash(path))
+}
+
+func contains(xs []string, x string) bool {
+	for _, v := range xs {
+		if v == x {
+			return true
+		}
+	}
+	return false
+}
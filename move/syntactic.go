@@ -0,0 +1,397 @@
+package move
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/podhmo/gomvpkg-light/build"
+	"github.com/podhmo/gomvpkg-light/collect"
+	"github.com/podhmo/gomvpkg-light/load"
+)
+
+// Syntactic : moving without type checking (only parsed files and the scope resolution of go/parser are used).
+// if the rewriting of a file is ambiguous (e.g. the new name may be shadowed), the file is rewritten with type information.
+type Syntactic struct {
+	Ctxt      *build.Context
+	Fset      *token.FileSet
+	Src       *collect.Target
+	Dst       *collect.Target
+	TypeCheck func(pkgs []string) (*load.Program, error) // loading the packages including ambiguous files (with Fset)
+
+	frompkg *types.Package
+	topkg   *types.Package
+	parsed  map[string]*ast.File // the files to be rewritten (a file is shared by the source and the affected packages)
+}
+
+// TargetPackage : renaming the package clause of the files in Src (including xxx_test package)
+func (s *Syntactic) TargetPackage(req *Req) error {
+	if err := s.setup(req); err != nil {
+		return err
+	}
+
+	files, err := s.parseDir(s.Src.Path, parser.ParseComments)
+	if err != nil {
+		return err
+	}
+	xtest := types.NewPackage(req.FromPkg+"_test", s.frompkg.Name()+"_test")
+	for _, f := range files {
+		k := s.Fset.File(f.Pos())
+		switch f.Name.Name {
+		case s.frompkg.Name():
+			renamePackage(s.Fset, f, s.topkg.Name(), req.ToPkg)
+			req.WillBeWrite[k] = &PreWrite{Pkg: s.frompkg, File: f}
+		case xtest.Name():
+			renamePackage(s.Fset, f, s.topkg.Name()+"_test", req.ToPkg+"_test")
+			req.WillBeWrite[k] = &PreWrite{Pkg: xtest, File: f}
+		default:
+			log.Printf("%s is skipped (package %s)", k.Name(), f.Name.Name)
+		}
+	}
+	return nil
+}
+
+// AffectedPackages : rewriting the affected packages. the ambiguous files are passed to TypeCheck
+func (s *Syntactic) AffectedPackages(req *Req) error {
+	if err := s.setup(req); err != nil {
+		return err
+	}
+
+	var ambiguous []collect.Affected
+	for _, a := range req.Affected {
+		fnames, err := s.apply(req, &a)
+		if err != nil {
+			return err
+		}
+		if len(fnames) > 0 {
+			a.Files = fnames
+			ambiguous = append(ambiguous, a)
+		}
+	}
+	if len(ambiguous) == 0 {
+		return nil
+	}
+
+	var pkgs []string
+	seen := map[string]bool{}
+	for _, a := range ambiguous {
+		log.Printf("ambiguous: %s/%s (type checking is needed)", a.Pkg, strings.Join(a.Files, ", "))
+		pkg := strings.TrimSuffix(a.Pkg, "_test")
+		if !seen[pkg] {
+			seen[pkg] = true
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	prog, err := s.TypeCheck(pkgs)
+	if err != nil {
+		return err
+	}
+	if prog.Fset != s.Fset {
+		return errors.New("ambiguous files are loaded with another FileSet")
+	}
+
+	m, err := newMover(s.Ctxt, prog, req)
+	if err != nil {
+		return err
+	}
+	byName := map[string]*token.File{}
+	for k := range req.WillBeWrite {
+		byName[k.Name()] = k
+	}
+	for _, a := range ambiguous {
+		if err := m.apply(&a); err != nil {
+			return err
+		}
+	}
+
+	// the files of the source package are parsed again, so the renaming of the package clause is taken over
+	for k, pw := range req.WillBeWrite {
+		old, ok := byName[k.Name()]
+		if !ok || old == k {
+			continue
+		}
+		if name := req.WillBeWrite[old].File.Name.Name; name != pw.File.Name.Name {
+			path := req.ToPkg
+			if strings.HasSuffix(name, "_test") {
+				path += "_test"
+			}
+			renamePackage(s.Fset, pw.File, name, path)
+		}
+		delete(req.WillBeWrite, old)
+	}
+	return nil
+}
+
+// apply rewrites the files of a, and returns the ambiguous files (not rewritten)
+func (s *Syntactic) apply(req *Req, a *collect.Affected) ([]string, error) {
+	pkg := types.NewPackage(a.Pkg, a.Name)
+
+	var files []*ast.File
+	for _, fname := range a.Files {
+		f, err := s.parseFile(a.Dir, fname, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	var decls map[string]bool // package-level declarations (loaded lazily)
+	var ambiguous []string
+	for i, f := range files {
+		fname := a.Files[i]
+		im, err := scanImports(s.Ctxt, nil, f, s.frompkg, s.topkg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "in %q", fname)
+		}
+		newName := s.topkg.Name()
+
+		if im.importsFrom {
+			if newName != im.importName && decls == nil {
+				if decls, err = s.packageDecls(a, files); err != nil {
+					return nil, err
+				}
+			}
+			if isAmbiguous(f, im, newName, decls) {
+				ambiguous = append(ambiguous, fname)
+				continue
+			}
+			for _, ident := range syntacticUsesOf(f, im.importName) {
+				ident.Name = newName
+			}
+		} else if req.FromPkg == req.ToPkg {
+			continue // only the package name is renamed, and the import is aliased (nothing is changed)
+		}
+
+		rewriteImports(s.Ctxt, s.Fset, f, im, s.frompkg, s.topkg, newName)
+
+		k := s.Fset.File(f.Pos())
+		req.WillBeWrite[k] = &PreWrite{
+			Pkg:  pkg,
+			File: f,
+		}
+	}
+	return ambiguous, nil
+}
+
+// setup sets the package names of the source and the destination (read from the package clause)
+func (s *Syntactic) setup(req *Req) error {
+	if s.frompkg != nil {
+		return nil
+	}
+
+	fromName, err := s.packageName(s.Src.Path)
+	if err != nil {
+		return err
+	}
+	if fromName == "" {
+		return errors.Errorf("not found pkg %s", req.FromPkg)
+	}
+	s.frompkg = types.NewPackage(req.FromPkg, fromName)
+
+	toName := req.ToName
+	if toName == "" && !s.Dst.NeedCreate {
+		if toName, err = s.packageName(s.Dst.Path); err != nil {
+			return err
+		}
+	}
+	if toName == "" {
+		elems := strings.Split(req.ToPkg, "/")
+		toName = elems[len(elems)-1]
+	}
+	s.topkg = types.NewPackage(req.ToPkg, toName)
+	return nil
+}
+
+// packageName returns the name of the package in dir (if not found, returns "")
+func (s *Syntactic) packageName(dir string) (string, error) {
+	fs, err := s.Ctxt.ReadDir(dir)
+	if err != nil {
+		return "", errors.Wrapf(err, "read %s", dir)
+	}
+	for _, f := range fs {
+		if !s.match(dir, f.Name()) || strings.HasSuffix(f.Name(), "_test.go") {
+			continue
+		}
+		astf, err := s.parseFile(dir, f.Name(), parser.PackageClauseOnly)
+		if err != nil {
+			return "", err
+		}
+		return astf.Name.Name, nil
+	}
+	return "", nil
+}
+
+// packageDecls returns the names of package-level declarations of a (parsed are the files of a, others are parsed here)
+func (s *Syntactic) packageDecls(a *collect.Affected, parsed []*ast.File) (map[string]bool, error) {
+	decls := map[string]bool{}
+	files := append([]*ast.File{}, parsed...)
+
+	seen := map[string]bool{}
+	for _, fname := range a.Files {
+		seen[fname] = true
+	}
+	fs, err := s.Ctxt.ReadDir(a.Dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", a.Dir)
+	}
+	for _, f := range fs {
+		if seen[f.Name()] || !s.match(a.Dir, f.Name()) {
+			continue
+		}
+		astf, err := s.parseFile(a.Dir, f.Name(), parser.SkipObjectResolution)
+		if err != nil {
+			return nil, err
+		}
+		if astf.Name.Name == a.Name {
+			files = append(files, astf)
+		}
+	}
+
+	for _, f := range files {
+		for _, decl := range f.Decls {
+			switch decl := decl.(type) {
+			case *ast.FuncDecl:
+				if decl.Recv == nil {
+					decls[decl.Name.Name] = true
+				}
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					switch spec := spec.(type) {
+					case *ast.ValueSpec:
+						for _, name := range spec.Names {
+							decls[name.Name] = true
+						}
+					case *ast.TypeSpec:
+						decls[spec.Name.Name] = true
+					}
+				}
+			}
+		}
+	}
+	return decls, nil
+}
+
+func (s *Syntactic) parseDir(dir string, mode parser.Mode) ([]*ast.File, error) {
+	fs, err := s.Ctxt.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", dir)
+	}
+	var files []*ast.File
+	for _, f := range fs {
+		if !s.match(dir, f.Name()) {
+			continue
+		}
+		astf, err := s.parseFile(dir, f.Name(), mode)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, astf)
+	}
+	return files, nil
+}
+
+func (s *Syntactic) parseFile(dir, fname string, mode parser.Mode) (*ast.File, error) {
+	path := s.Ctxt.JoinPath(dir, fname)
+	if f, ok := s.parsed[path]; ok {
+		return f, nil
+	}
+
+	r, err := s.Ctxt.OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	f, err := parser.ParseFile(s.Fset, path, r, mode)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse %s", path)
+	}
+	if mode&parser.ParseComments != 0 {
+		if s.parsed == nil {
+			s.parsed = map[string]*ast.File{}
+		}
+		s.parsed[path] = f
+	}
+	return f, nil
+}
+
+// match reports whether the file is a go file, matched with the build context (like go list)
+func (s *Syntactic) match(dir, fname string) bool {
+	if !strings.HasSuffix(fname, ".go") {
+		return false
+	}
+	ok, err := s.Ctxt.Ctxt.MatchFile(dir, fname)
+	return err == nil && ok
+}
+
+// syntacticUsesOf returns the identifiers referring to the imported package (name), resolved by go/parser
+func syntacticUsesOf(f *ast.File, name string) []*ast.Ident {
+	var uses []*ast.Ident
+	ast.Inspect(f, func(node ast.Node) bool {
+		if sel, _ := node.(*ast.SelectorExpr); sel != nil {
+			// the local declarations are resolved (Obj is not nil), the imported package names are not
+			if ident, _ := sel.X.(*ast.Ident); ident != nil && ident.Obj == nil && ident.Name == name {
+				uses = append(uses, ident)
+			}
+		}
+		return true
+	})
+	return uses
+}
+
+// versionRX : the major version suffix of the import path (module, or gopkg.in)
+var versionRX = regexp.MustCompile(`^v[0-9]+$`)
+
+// isAmbiguous reports whether the renaming of the file needs type information.
+//
+// - dot import is existed (unresolved identifiers may be the members of the package)
+// - the package name of an unnamed import cannot be guessed from the path (e.g. x/v2)
+// - another same name import is existed (conflict)
+// - the new name is declared at package-level
+// - the new name is used in the file (as local declaration, universe object, ...)
+func isAmbiguous(f *ast.File, im *imports, newName string, decls map[string]bool) bool {
+	for _, is := range f.Imports {
+		if is.Name != nil && is.Name.Name == "." {
+			return true
+		}
+		if path, _ := strconv.Unquote(is.Path.Value); is.Name == nil && (!token.IsIdentifier(pathName(path)) || versionRX.MatchString(pathName(path))) {
+			return true // the package name cannot be guessed from the path (e.g. x/v2, gopkg.in/yaml.v2)
+		}
+	}
+	if len(im.seen[newName]) > 1 {
+		return true
+	}
+	if newName == im.importName {
+		return false
+	}
+	if decls[newName] {
+		return true
+	}
+
+	skip := map[*ast.Ident]bool{f.Name: true}
+	for _, is := range f.Imports {
+		if is.Name != nil {
+			skip[is.Name] = true
+		}
+	}
+	ast.Inspect(f, func(node ast.Node) bool {
+		if sel, _ := node.(*ast.SelectorExpr); sel != nil {
+			skip[sel.Sel] = true // a field or a method
+		}
+		return true
+	})
+
+	found := false
+	ast.Inspect(f, func(node ast.Node) bool {
+		if ident, _ := node.(*ast.Ident); ident != nil && !skip[ident] && ident.Name == newName {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
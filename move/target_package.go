@@ -1,12 +1,14 @@
 package move
 
 import (
+	"go/ast"
 	"go/token"
+	"path/filepath"
 	"regexp"
 	"strings"
 
 	"github.com/pkg/errors"
-	"golang.org/x/tools/go/loader"
+	"github.com/podhmo/gomvpkg-light/load"
 )
 
 var (
@@ -14,50 +16,73 @@ var (
 )
 
 // TargetPackage :
-func TargetPackage(prog *loader.Program, req *Req) error {
+func TargetPackage(prog *load.Program, req *Req) error {
 	from := prog.Package(req.FromPkg)
 	if from == nil {
 		return errors.Errorf("not found pkg %s", req.FromPkg)
 	}
 
-	to := prog.Package(req.ToPkg)
-	var pkgname string
-	if to != nil {
-		pkgname = to.Pkg.Name()
-	} else {
-		elems := strings.Split(req.ToPkg, "/")
-		pkgname = elems[len(elems)-1]
-	}
+	pkgname := req.toPackage(prog).Name()
 
-	for _, f := range from.Files {
+	for _, f := range from.Syntax {
 		f := f
-		f.Name.Name = pkgname
+		renamePackage(prog.Fset, f, pkgname, req.ToPkg)
+		if req.Merge {
+			unimport(prog.Fset, from, f, req.ToPkg) // merged into the same package
+		}
 		k := prog.Fset.File(f.Pos())
 		req.WillBeWrite[k] = &PreWrite{
-			Pkg:  from.Pkg,
+			Pkg:  from.Types,
 			File: f,
 		}
+	}
+	return nil
+}
 
-		// Update all import comments.
-		for _, cg := range f.Comments {
-			c := cg.List[0]
-			if c.Slash >= f.Name.End() &&
-				sameLine(prog.Fset, c.Slash, f.Name.End()) &&
-				(f.Decls == nil || c.Slash < f.Decls[0].Pos()) {
-				if strings.HasPrefix(c.Text, `// import "`) {
-					c.Text = `// import "` + req.ToPkg + `"`
-					break
-				}
-				if strings.HasPrefix(c.Text, `/* import "`) {
-					c.Text = `/* import "` + req.ToPkg + `" */`
-					break
-				}
-			}
+// TargetFiles : renaming the package clause of the files of FromPkg (only fnames are moved into ToPkg)
+func TargetFiles(prog *load.Program, req *Req, fnames []string) error {
+	from := prog.Package(req.FromPkg)
+	if from == nil {
+		return errors.Errorf("not found pkg %s", req.FromPkg)
+	}
+
+	topkg := req.toPackage(prog)
+	for _, f := range from.Syntax {
+		k := prog.Fset.File(f.Pos())
+		if !contains(fnames, filepath.Base(k.Name())) {
+			continue
+		}
+		renamePackage(prog.Fset, f, topkg.Name(), req.ToPkg)
+		req.WillBeWrite[k] = &PreWrite{
+			Pkg:  topkg,
+			File: f,
 		}
 	}
 	return nil
 }
 
+// renamePackage renames the package clause, and updates the import comment
+func renamePackage(fset *token.FileSet, f *ast.File, pkgname string, path string) {
+	f.Name.Name = pkgname
+
+	// Update all import comments.
+	for _, cg := range f.Comments {
+		c := cg.List[0]
+		if c.Slash >= f.Name.End() &&
+			sameLine(fset, c.Slash, f.Name.End()) &&
+			(f.Decls == nil || c.Slash < f.Decls[0].Pos()) {
+			if strings.HasPrefix(c.Text, `// import "`) {
+				c.Text = `// import "` + path + `"`
+				break
+			}
+			if strings.HasPrefix(c.Text, `/* import "`) {
+				c.Text = `/* import "` + path + `" */`
+				break
+			}
+		}
+	}
+}
+
 // sameLine reports whether two positions in the same file are on the same line.
 func sameLine(fset *token.FileSet, x, y token.Pos) bool {
 	return fset.Position(x).Line == fset.Position(y).Line
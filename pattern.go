@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/podhmo/gomvpkg-light/build"
+	"github.com/podhmo/gomvpkg-light/collect"
+)
+
+// Pattern : the pattern of moves (`...` wildcard, or regular expression with capture groups)
+type Pattern struct {
+	rx       *regexp.Regexp
+	template string // e.g. "example.com/app/v2$1"
+}
+
+// IsPattern reports whether path includes `...` wildcard
+func IsPattern(path string) bool {
+	return strings.Contains(path, "...")
+}
+
+// CompilePattern compiles the pattern with `...` wildcards (like the go tool, "x/..." matches x and its sub packages).
+// the wildcards of from are replaced by the wildcards of to, in order.
+func CompilePattern(from, to string) (*Pattern, error) {
+	if n, m := strings.Count(from, "..."), strings.Count(to, "..."); n != m {
+		return nil, errors.Errorf("the number of wildcards is mismatched (from %s, to %s)", from, to)
+	}
+
+	trailing := strings.HasSuffix(from, "/...") && strings.HasSuffix(to, "/...")
+	if trailing {
+		from = strings.TrimSuffix(from, "/...")
+		to = strings.TrimSuffix(to, "/...")
+	}
+
+	var rx, template strings.Builder
+	rx.WriteString("^")
+	for i, part := range strings.Split(from, "...") {
+		if i > 0 {
+			rx.WriteString("(.*)")
+		}
+		rx.WriteString(regexp.QuoteMeta(part))
+	}
+	for i, part := range strings.Split(to, "...") {
+		if i > 0 {
+			template.WriteString("${" + strconv.Itoa(i) + "}")
+		}
+		template.WriteString(strings.Replace(part, "$", "$$", -1))
+	}
+	if trailing {
+		rx.WriteString("(/.*)?")
+		template.WriteString("${" + strconv.Itoa(strings.Count(from, "...")+1) + "}")
+	}
+	rx.WriteString("$")
+	return &Pattern{rx: regexp.MustCompile(rx.String()), template: template.String()}, nil
+}
+
+// CompileRegexp compiles the regular expression (matched with the whole import path). to can refer to the capture groups ($1, ${name}).
+func CompileRegexp(from, to string) (*Pattern, error) {
+	rx, err := regexp.Compile("^(?:" + from + ")$")
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid pattern")
+	}
+	return &Pattern{rx: rx, template: to}, nil
+}
+
+// Expand expands the pattern against the packages in the candidate directories, and returns the moves.
+// the packages moved together with the parent package (recursively) are not included.
+func (p *Pattern) Expand(ctxt *build.Context, root *collect.Target, pkgdirs []string) (*Manifest, error) {
+	m := &Manifest{}
+	for _, dir := range pkgdirs {
+		pkg := root.ImportPath(dir)
+		match := p.rx.FindStringSubmatchIndex(pkg)
+		if match == nil {
+			continue
+		}
+		to := string(p.rx.ExpandString(nil, p.template, pkg, match))
+
+		covered := false
+		for _, x := range m.Moves {
+			if ctxt.MatchPkg(x.From, pkg) && ctxt.RenamePkg(x.From, x.To, pkg) == to {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			m.Moves = append(m.Moves, Move{From: pkg, To: to})
+		}
+	}
+	if len(m.Moves) == 0 {
+		return nil, errors.Errorf("no packages are matched with %s", p.rx)
+	}
+	return m, nil
+}
+
+// runPattern applies the moves expanded from the pattern (--from, --to)
+func runPattern(ctxt *build.Context, option *option) error {
+	log.Printf("start move packages %s -> %s", option.fromPkg, option.toPkg)
+
+	compile := CompilePattern
+	if option.regexp {
+		compile = CompileRegexp
+	}
+	p, err := compile(option.fromPkg, option.toPkg)
+	if err != nil {
+		return err
+	}
+	return runMoves(ctxt, option, func(root *collect.Target, pkgdirs []string) (*Manifest, error) {
+		return p.Expand(ctxt, root, pkgdirs)
+	})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/podhmo/gomvpkg-light/build"
+	"github.com/podhmo/gomvpkg-light/collect"
+	"github.com/podhmo/gomvpkg-light/load"
+	"github.com/podhmo/gomvpkg-light/move"
+)
+
+// session : the steps shared by the moves (run, runMoves, runSplit)
+type session struct {
+	ctxt    *build.Context
+	option  *option
+	root    *collect.Target
+	config  *load.Config
+	pkgdirs []string
+}
+
+// newSession finds the target area (--in)
+func newSession(ctxt *build.Context, option *option) (*session, error) {
+	root, err := collect.TargetRoot(ctxt, option.inPkg)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("get in-pkg %s", root.Path)
+
+	c := &load.Config{Verbose: option.verbose}
+	if option.unsafe {
+		log.Println("unsafe option is enabled, type errors are ignored")
+		c.AllowErrors = true
+	}
+	return &session{ctxt: ctxt, option: option, root: root, config: c}, nil
+}
+
+// logElapsed is called at the end of the session (deferred)
+func logElapsed(st time.Time) {
+	log.Printf("takes %v", time.Now().Sub(st))
+	log.Println("end")
+}
+
+// preflight checks that the working tree is clean (unless --dry-run or --force), and the vcs can commit (--commit),
+// before anything is written
+func (s *session) preflight(paths ...string) error {
+	if s.option.dryRun {
+		return nil
+	}
+	if s.option.commit {
+		vcs := s.ctxt.VCS
+		if vcs == build.Auto {
+			vcs = build.DetectVCS(s.root.Path)
+		}
+		if vcs == build.FileSystem {
+			return errors.Errorf("commit option needs vcs (git or hg), but %s is not managed by vcs", s.root.Path)
+		}
+	}
+	if s.option.force {
+		return nil
+	}
+	return preflight(s.ctxt, append([]string{s.root.Path}, paths...)...)
+}
+
+// collect collects the candidate directories in the target area
+func (s *session) collect() error {
+	pkgdirs, err := collect.GoFilesDirectories(context.Background(), s.ctxt, s.root)
+	if err != nil {
+		return err
+	}
+	log.Printf("collect candidate directories %d", len(pkgdirs))
+	s.pkgdirs = pkgdirs
+	return nil
+}
+
+// affected returns the affected packages of each pkg (the import index is used, if --cache-dir)
+func (s *session) affected(pkgs ...string) ([][]collect.Affected, error) {
+	var idx *collect.Index
+	if s.option.cacheDir != "" {
+		var err error
+		idx, err = collect.OpenIndex(collect.IndexPath(s.option.cacheDir, s.root))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r := make([][]collect.Affected, len(pkgs))
+	for i, pkg := range pkgs {
+		affected, err := collect.AffectedPackages(s.ctxt, pkg, s.root, s.pkgdirs, idx)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("collect affected packages %d (%s)", len(affected), pkg)
+		r[i] = affected
+	}
+	if err := idx.Save(); err != nil {
+		log.Printf("failed to save index (%s)", err)
+	}
+	return r, nil
+}
+
+// load loads the packages (slow)
+func (s *session) load(pkgs []string) (*load.Program, error) {
+	log.Println("loading packages..")
+	prog, err := s.config.Load(s.ctxt, s.root, pkgs)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("%d packages are loaded", len(prog.AllPackages))
+	return prog, nil
+}
+
+// transact calls fn with the context writing the files via journal (if fn is failed, all changes are rolled back)
+func (s *session) transact(fn func(wctxt *build.Context) error) error {
+	if s.option.dryRun {
+		if s.option.verify || s.option.commit {
+			log.Println("verify and commit options are ignored in dry-run mode")
+		}
+		return fn(s.ctxt)
+	}
+
+	wctxt, journal := build.Transactional(s.ctxt)
+	err := fn(wctxt)
+	if err == nil {
+		return nil
+	}
+	log.Printf("failed, rollback (%s)", err)
+	if rerr := journal.Rollback(); rerr != nil {
+		return errors.Wrapf(err, "%s", rerr)
+	}
+	return err
+}
+
+// result : the outcome of the move, for verifying and committing
+type result struct {
+	existed []load.Error        // the errors existed before moving
+	pkgs    []string            // the loaded packages (before moving)
+	rename  func(string) string // converts an import path before moving to the one after moving
+	req     *move.Req           // the rewritten files and the conflicts
+	header  string              // the header of the commit message
+	srcs    []*collect.Target   // the moved packages
+	dsts    []*collect.Target   // the destinations of srcs
+}
+
+// finish type checks after moving (--verify), and commits the move (--commit)
+func (s *session) finish(r *result) error {
+	if s.option.dryRun {
+		return nil
+	}
+	if s.option.verify {
+		if err := verify(s.ctxt, s.config, s.root, r.existed, r.pkgs, r.rename); err != nil {
+			return err
+		}
+	}
+	if s.option.commit {
+		return commit(s.ctxt, r.req, commitMessage(r.header, r.req), r.srcs, r.dsts)
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"go/token"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/podhmo/gomvpkg-light/build"
+	"github.com/podhmo/gomvpkg-light/collect"
+	"github.com/podhmo/gomvpkg-light/move"
+)
+
+// ExpandFiles returns the go files in dir, matched with the comma separated names (or glob patterns)
+func ExpandFiles(ctxt *build.Context, dir string, files string) ([]string, error) {
+	fs, err := ctxt.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", dir)
+	}
+
+	seen := map[string]bool{}
+	var fnames []string
+	for _, pattern := range strings.Split(files, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid pattern %q", pattern)
+		}
+		matched := false
+		for _, f := range fs {
+			if ok, _ := path.Match(pattern, f.Name()); !ok || f.IsDir() || !strings.HasSuffix(f.Name(), ".go") {
+				continue
+			}
+			matched = true
+			if !seen[f.Name()] {
+				seen[f.Name()] = true
+				fnames = append(fnames, f.Name())
+			}
+		}
+		if !matched {
+			return nil, errors.Errorf("no files are matched with %s", pattern)
+		}
+	}
+	if len(fnames) == 0 {
+		return nil, errors.New("no files are selected")
+	}
+	sort.Strings(fnames)
+	return fnames, nil
+}
+
+// runSplit moves the selected files of the package into the new package (--files),
+// or the selected declarations into the new (or existing) package (--decls)
+func runSplit(ctxt *build.Context, option *option) error {
+	if option.decls != "" {
+		log.Printf("start move declarations %s -> %s (%s)", option.fromPkg, option.toPkg, option.decls)
+	} else {
+		log.Printf("start split package %s -> %s (files %s)", option.fromPkg, option.toPkg, option.files)
+	}
+	defer logElapsed(time.Now())
+
+	if option.syntactic || option.batch > 0 {
+		log.Println("syntactic and batch options are ignored with splitting")
+	}
+
+	s, err := newSession(ctxt, option)
+	if err != nil {
+		return err
+	}
+
+	srctarget, err := collect.TargetRoot(ctxt, option.fromPkg)
+	if err != nil {
+		return errors.Errorf("invalid source %s", option.fromPkg)
+	}
+	dsttarget, err := collect.TargetRoot(ctxt, option.toPkg)
+	if err != nil {
+		if dsttarget, err = collect.NewTarget(ctxt, srctarget, option.toPkg); err != nil {
+			return errors.Wrap(err, "invalid destination")
+		}
+	} else if option.decls == "" {
+		return errors.Errorf("%s is existed (splitting into the new package only)", option.toPkg)
+	}
+
+	var fnames, names []string
+	if option.decls != "" {
+		for _, name := range strings.Split(option.decls, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	} else {
+		fnames, err = ExpandFiles(ctxt, srctarget.Path, option.files)
+		if err != nil {
+			return err
+		}
+		log.Printf("selected files %s", strings.Join(fnames, ", "))
+	}
+
+	if err := s.preflight(srctarget.Path, dsttarget.Path); err != nil {
+		return err
+	}
+	if err := s.collect(); err != nil {
+		return err
+	}
+	affected, err := s.affected(option.fromPkg)
+	if err != nil {
+		return err
+	}
+
+	pkgs := []string{option.fromPkg}
+	if !dsttarget.NeedCreate {
+		pkgs = append(pkgs, option.toPkg)
+	}
+	for _, a := range affected[0] {
+		pkgs = append(pkgs, strings.TrimSuffix(a.Pkg, "_test"))
+	}
+
+	prog, err := s.load(pkgs)
+	if err != nil {
+		return err
+	}
+
+	req := &move.Req{
+		FromPkg:     option.fromPkg,
+		ToPkg:       option.toPkg,
+		InPkg:       option.inPkg,
+		Root:        s.root,
+		Affected:    affected[0],
+		WillBeWrite: map[*token.File]*move.PreWrite{},
+		Verbose:     option.verbose,
+	}
+	var sp *move.Split
+	if option.decls != "" {
+		sp, err = move.SplitDecls(prog, req, names)
+	} else {
+		sp, err = move.SplitFiles(prog, req, fnames)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("moved declarations %s", strings.Join(sp.Moved(), ", "))
+
+	conflicts := sp.Conflicts()
+	if len(conflicts) > 0 {
+		for _, msg := range conflicts {
+			log.Printf("conflict: %s", msg)
+		}
+		return errors.Errorf("cannot split, %d conflicts are found", len(conflicts))
+	}
+
+	if option.decls != "" {
+		existed := func(fname string) bool {
+			if dsttarget.NeedCreate {
+				return false
+			}
+			r, err := ctxt.OpenFile(ctxt.JoinPath(dsttarget.Path, fname))
+			if err != nil {
+				return false
+			}
+			r.Close()
+			return true
+		}
+		if err := sp.ExtractDecls(dsttarget.Path, existed); err != nil {
+			return err
+		}
+		if err := sp.Apply(); err != nil {
+			return err
+		}
+	} else {
+		if err := sp.Apply(); err != nil {
+			return err
+		}
+		if err := move.TargetFiles(prog, req, fnames); err != nil {
+			return err
+		}
+	}
+
+	err = s.transact(func(wctxt *build.Context) error {
+		if option.decls != "" {
+			// the declarations are written into the new files
+			if err := wctxt.MkdirAll(dsttarget.Path); err != nil {
+				return err
+			}
+		}
+		if err := write(wctxt, prog.Fset, req, option); err != nil {
+			return err
+		}
+		logStat(req)
+		if option.decls != "" {
+			return nil
+		}
+		return moveFiles(wctxt, srctarget, dsttarget, fnames)
+	})
+	if err != nil {
+		return err
+	}
+
+	if dsttarget.NeedCreate {
+		pkgs = append(pkgs, option.toPkg)
+	}
+	header := fmt.Sprintf("split package %s -> %s\n\n- %s\n", req.FromPkg, req.ToPkg, strings.Join(fnames, "\n- "))
+	if option.decls != "" {
+		header = fmt.Sprintf("move declarations %s -> %s\n\n- %s\n", req.FromPkg, req.ToPkg, strings.Join(sp.Moved(), "\n- "))
+	}
+	return s.finish(&result{
+		existed: prog.Errors(),
+		pkgs:    pkgs,
+		rename:  func(path string) string { return path },
+		req:     req,
+		header:  header,
+		srcs:    []*collect.Target{srctarget},
+		dsts:    []*collect.Target{dsttarget},
+	})
+}
+
+// moveFiles moves the files into the new package
+func moveFiles(ctxt *build.Context, srctarget, dsttarget *collect.Target, fnames []string) error {
+	if err := ctxt.MkdirAll(dsttarget.Path); err != nil {
+		return err
+	}
+	log.Printf("move files %s -> %s", srctarget.Pkg, dsttarget.Pkg)
+	for _, fname := range fnames {
+		if err := ctxt.Move(ctxt.JoinPath(srctarget.Path, fname), ctxt.JoinPath(dsttarget.Path, fname)); err != nil {
+			return err
+		}
+	}
+	return nil
+}